@@ -55,8 +55,9 @@ func cinspect(t ctypes.Type) {
 	fmt.Printf("=== inspecting [ctypes.%v] ===\n", t)
 	for i := 0; i < nfields; i++ {
 		f := t.Field(i)
-		fmt.Printf(":: [%s] '%v' off:%d sz:%d\n", 
-			f.Name, f.Type, f.Offset, f.Type.Size())
+		fmt.Printf(":: [%s] '%v' off:%d sz:%d al:%d fal:%d\n", 
+			f.Name, f.Type, f.Offset, f.Type.Size(),
+			f.Type.Align(), f.Type.FieldAlign())
 	}
 	fmt.Printf("=== inspecting [ctypes.%v] === [done]\n", t)
 }
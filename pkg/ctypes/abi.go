@@ -0,0 +1,333 @@
+package ctypes
+
+/*
+ #include <stddef.h>
+ #include <stdint.h>
+
+ struct ctypes_falign_2 { char c; int16_t x; };
+ struct ctypes_falign_4 { char c; int32_t x; };
+ struct ctypes_falign_8 { char c; int64_t x; };
+
+ enum {
+	 ctypes_align_2 = __alignof__(int16_t),
+	 ctypes_align_4 = __alignof__(int32_t),
+	 ctypes_align_8 = __alignof__(int64_t),
+
+	 ctypes_falign_2 = offsetof(struct ctypes_falign_2, x),
+	 ctypes_falign_4 = offsetof(struct ctypes_falign_4, x),
+	 ctypes_falign_8 = offsetof(struct ctypes_falign_8, x),
+ };
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// An ABI describes the data model of a C target: the sizes and
+// alignments of its scalar types and its byte order.
+//
+// Go int, uint and uintptr are mapped onto PtrSize-bytes integers, so they
+// keep the width they would have if the Go program was built for the target.
+// Pointers and C-strings written in a Value for another ABI than Host only
+// have their layout right: their content is not meaningful on the target.
+// Decoding such a Value yields nil Go pointers and slices.
+type ABI struct {
+	Name      string
+	PtrSize   uintptr          // sizeof(void*)
+	LongSize  uintptr          // sizeof(long)
+	ByteOrder binary.ByteOrder // byte order of multi-byte scalars
+
+	// Align and FieldAlign map the size of a scalar to its alignment,
+	// respectively as a standalone object and as a struct field.
+	// A missing entry means the scalar is naturally aligned.
+	Align      map[uintptr]uintptr
+	FieldAlign map[uintptr]uintptr
+
+	// Pack is the maximum alignment of the fields of structs and unions,
+	// as set by #pragma pack(n), or 1 for __attribute__((packed)).
+	// 0 means the fields are naturally aligned. see WithPack.
+	Pack uintptr
+
+	root  *ABI             // the ABI this one is a packed variant of, nil if none
+	packs map[uintptr]*ABI // the packed variants of this ABI
+
+	mu      sync.RWMutex      // protects ctypeds and packs
+	ctypeds map[type_key]Type // map of already translated-to-Ctypes types, of this ABI and its packed variants
+}
+
+// a key of the types cache of an ABI: the same Go type is laid out
+// differently by the packed variants of the ABI
+type type_key struct {
+	t    reflect.Type
+	pack uintptr
+}
+
+// natural_align returns an alignment table where each scalar is
+// aligned on its own size.
+func natural_align() map[uintptr]uintptr {
+	return map[uintptr]uintptr{1: 1, 2: 2, 4: 4, 8: 8}
+}
+
+var (
+	// LP64 is the data model of 64-bit Linux, BSD and Mac OS X (amd64, arm64)
+	LP64 = &ABI{
+		Name:       "LP64",
+		PtrSize:    8,
+		LongSize:   8,
+		ByteOrder:  binary.LittleEndian,
+		Align:      natural_align(),
+		FieldAlign: natural_align(),
+	}
+
+	// LLP64 is the data model of 64-bit Windows
+	LLP64 = &ABI{
+		Name:       "LLP64",
+		PtrSize:    8,
+		LongSize:   4,
+		ByteOrder:  binary.LittleEndian,
+		Align:      natural_align(),
+		FieldAlign: natural_align(),
+	}
+
+	// ILP32 is the data model of 32-bit ARM (EABI) and 32-bit Windows
+	ILP32 = &ABI{
+		Name:       "ILP32",
+		PtrSize:    4,
+		LongSize:   4,
+		ByteOrder:  binary.LittleEndian,
+		Align:      natural_align(),
+		FieldAlign: natural_align(),
+	}
+
+	// I386 is the data model of 32-bit x86 Linux (System V i386 ABI),
+	// where 8-byte scalars are only 4-byte aligned within structs
+	I386 = &ABI{
+		Name:       "I386",
+		PtrSize:    4,
+		LongSize:   4,
+		ByteOrder:  binary.LittleEndian,
+		Align:      natural_align(),
+		FieldAlign: map[uintptr]uintptr{1: 1, 2: 2, 4: 4, 8: 4},
+	}
+
+	// LP64BE is the data model of big-endian 64-bit Linux (ppc64, s390x)
+	LP64BE = LP64.WithByteOrder(binary.BigEndian)
+
+	// ILP32BE is the data model of big-endian 32-bit targets (mips, powerpc)
+	ILP32BE = ILP32.WithByteOrder(binary.BigEndian)
+
+	// Host is the data model of the machine the program is running on
+	Host = &ABI{
+		Name:      "Host",
+		PtrSize:   unsafe.Sizeof(uintptr(0)),
+		LongSize:  C.sizeof_long,
+		ByteOrder: host_byte_order(),
+		Align: map[uintptr]uintptr{
+			1: 1,
+			2: C.ctypes_align_2,
+			4: C.ctypes_align_4,
+			8: C.ctypes_align_8,
+		},
+		FieldAlign: map[uintptr]uintptr{
+			1: 1,
+			2: C.ctypes_falign_2,
+			4: C.ctypes_falign_4,
+			8: C.ctypes_falign_8,
+		},
+	}
+)
+
+func host_byte_order() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func (abi *ABI) String() string {
+	return abi.Name
+}
+
+// WithByteOrder returns a copy of this ABI whose multi-byte scalars,
+// complex parts and vl-array sizes are encoded and decoded in the given
+// byte order, e.g. to talk to a big-endian device or a network peer.
+// The returned ABI has its own types cache: it should be created once
+// and reused.
+func (abi *ABI) WithByteOrder(order binary.ByteOrder) *ABI {
+	o := &ABI{
+		Name:       abi.Name + "-" + order.String(),
+		PtrSize:    abi.PtrSize,
+		LongSize:   abi.LongSize,
+		ByteOrder:  order,
+		Align:      abi.Align,
+		FieldAlign: abi.FieldAlign,
+		Pack:       abi.Pack,
+	}
+	return o
+}
+
+// WithPack returns the variant of this ABI where the fields of structs and
+// unions are aligned on at most n bytes, as with #pragma pack(n), or with
+// __attribute__((packed)) for n = 1. n = 0 gives back the unpacked ABI.
+// The same Go type can thus be laid out both packed and naturally:
+//
+//	ctypes.TypeOf(Header{})                   // natural layout
+//	ctypes.Host.WithPack(1).TypeOf(Header{})  // packed layout
+//
+// A struct field is laid out packed with a `ctypes:"pack=n"` tag, or a
+// `ctypes:"packed"` one. Bit-fields are not supported in packed structs.
+// Variants share the types cache of their ABI, and are created once.
+func (abi *ABI) WithPack(n uintptr) *ABI {
+	r := abi.types_root()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return abi.packed(n)
+}
+
+// packed returns the variant of this ABI with the given pack.
+// the lock of abi.types_root() must be held.
+func (abi *ABI) packed(n uintptr) *ABI {
+	if n&(n-1) != 0 {
+		panic(fmt.Sprintf("ctypes: invalid pack [%d]", n))
+	}
+	r := abi.types_root()
+	if n == r.Pack {
+		return r
+	}
+	if p, ok := r.packs[n]; ok {
+		return p
+	}
+	p := &ABI{
+		Name:       r.Name + "-pack" + strconv.Itoa(int(n)),
+		PtrSize:    r.PtrSize,
+		LongSize:   r.LongSize,
+		ByteOrder:  r.ByteOrder,
+		Align:      r.Align,
+		FieldAlign: r.FieldAlign,
+		Pack:       n,
+		root:       r,
+	}
+	if r.packs == nil {
+		r.packs = make(map[uintptr]*ABI)
+	}
+	r.packs[n] = p
+	return p
+}
+
+// types_root returns the ABI holding the types cache of this ABI
+func (abi *ABI) types_root() *ABI {
+	if abi.root != nil {
+		return abi.root
+	}
+	return abi
+}
+
+// register records the C type c of the Go type t in the types cache.
+// the lock of abi.types_root() must be held.
+func (abi *ABI) register(t reflect.Type, c Type) {
+	abi.types_root().ctypeds[type_key{t, abi.Pack}] = c
+}
+
+// unregister removes the Go type t from the types cache.
+// the lock of abi.types_root() must be held.
+func (abi *ABI) unregister(t reflect.Type) {
+	delete(abi.types_root().ctypeds, type_key{t, abi.Pack})
+}
+
+// TypeOf returns the C type corresponding to the Go value v,
+// laid out for this ABI
+func (abi *ABI) TypeOf(v interface{}) Type {
+	t, err := abi.TypeOfErr(v)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// TypeOfErr is like TypeOf but returns an error instead of panicking.
+func (abi *ABI) TypeOfErr(v interface{}) (Type, error) {
+	return abi.ctype_of(reflect.TypeOf(v))
+}
+
+// ctype_of is like gotype_to_ctype but returns an error, whose path
+// starts with the name of t, instead of panicking.
+func (abi *ABI) ctype_of(t reflect.Type) (ct Type, err error) {
+	defer catch_error(t, &err)
+	return abi.gotype_to_ctype(t), nil
+}
+
+// ValueOf returns the ctypes.Value corresponding to the Go-value v,
+// laid out for this ABI
+func (abi *ABI) ValueOf(v interface{}) *Value {
+	cv, err := abi.ValueOfErr(v)
+	if err != nil {
+		panic(err)
+	}
+	return cv
+}
+
+// ValueOfErr is like ValueOf but returns an error instead of panicking.
+func (abi *ABI) ValueOfErr(v interface{}) (cv *Value, err error) {
+	rv := reflect.ValueOf(v)
+	//fmt.Printf("valueof--> %v\n",rv)
+	rv = follow_ptr(rv)
+	//fmt.Printf("valueof==> %v\n",rv)
+	if !rv.IsValid() {
+		return nil, &UnsupportedTypeError{}
+	}
+	ct, err := abi.ctype_of(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	return New(ct), nil
+}
+
+// host_pointers returns whether the pointers stored for this ABI
+// are the addresses of the Host, and can thus be followed.
+func (abi *ABI) host_pointers() bool {
+	return abi.PtrSize == Host.PtrSize && abi.ByteOrder == Host.ByteOrder
+}
+
+// sizeof returns the size of a scalar or pointer Go type on the target
+func (abi *ABI) sizeof(t reflect.Type) uintptr {
+	switch t.Kind() {
+	case reflect.Int, reflect.Uint, reflect.Uintptr,
+		reflect.Ptr, reflect.UnsafePointer:
+		return abi.PtrSize
+	}
+	return t.Size()
+}
+
+// alignof returns the alignment of a scalar of size sz
+func (abi *ABI) alignof(sz uintptr) uintptr {
+	if a, ok := abi.Align[sz]; ok {
+		return a
+	}
+	return sz
+}
+
+// field_alignof returns the alignment of a scalar of size sz within a struct
+func (abi *ABI) field_alignof(sz uintptr) uintptr {
+	if a, ok := abi.FieldAlign[sz]; ok {
+		return a
+	}
+	return sz
+}
+
+// pack_align returns the alignment of a field of a struct or union whose
+// alignment would be a, once packed
+func (abi *ABI) pack_align(a uintptr) uintptr {
+	if abi.Pack != 0 && a > abi.Pack {
+		return abi.Pack
+	}
+	return a
+}
+
+// EOF
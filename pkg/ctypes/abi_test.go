@@ -0,0 +1,106 @@
+package ctypes
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+// the layouts gcc gives on each target, with -m32 for I386
+func TestLayoutABI(t *testing.T) {
+	for _, test := range []struct {
+		abi         *ABI
+		v           interface{}
+		size, align uintptr
+		offsets     []uintptr
+	}{
+		{LP64, ref_natural{}, 32, 8, []uintptr{0, 8, 16, 20, 24}},
+		{LLP64, ref_natural{}, 32, 8, []uintptr{0, 8, 16, 20, 24}},
+		{ILP32, ref_natural{}, 32, 8, []uintptr{0, 8, 16, 20, 24}},
+		{I386, ref_natural{}, 24, 4, []uintptr{0, 4, 12, 16, 20}},
+
+		{LP64, ref_arrays{}, 32, 8, []uintptr{0, 4, 16, 24}},
+		{LLP64, ref_arrays{}, 32, 8, []uintptr{0, 4, 16, 24}},
+		{ILP32, ref_arrays{}, 24, 4, []uintptr{0, 4, 16, 20}},
+		{I386, ref_arrays{}, 24, 4, []uintptr{0, 4, 16, 20}},
+
+		{LP64, ref_mixed{}, 40, 8, []uintptr{0, 8, 16, 20, 24, 32}},
+		{LLP64, ref_mixed{}, 40, 8, []uintptr{0, 8, 16, 20, 24, 32}},
+		{ILP32, ref_mixed{}, 32, 8, []uintptr{0, 4, 8, 12, 16, 24}},
+		{I386, ref_mixed{}, 28, 4, []uintptr{0, 4, 8, 12, 16, 20}},
+
+		{ILP32, ref_tail{}, 16, 8, []uintptr{0, 8}},
+		{I386, ref_tail{}, 12, 4, []uintptr{0, 8}},
+	} {
+		ref := cref.Layout{Size: test.size, Align: test.align, Offsets: test.offsets}
+		check_layout(t, test.abi, test.abi.Name, test.v, ref)
+	}
+}
+
+func TestABIScalars(t *testing.T) {
+	for _, test := range []struct {
+		abi           *ABI
+		v             interface{}
+		size          uintptr
+		align, falign int
+	}{
+		{LP64, int(0), 8, 8, 8},
+		{LLP64, int(0), 8, 8, 8},
+		{ILP32, int(0), 4, 4, 4},
+		{ILP32, &ref_tail{}, 4, 4, 4},
+		{ILP32, "", 4, 4, 4},
+		{I386, float64(0), 8, 8, 4},
+		{I386, int64(0), 8, 8, 4},
+		{ILP32, float64(0), 8, 8, 8},
+	} {
+		ct := test.abi.TypeOf(test.v)
+		if ct.Size() != test.size || ct.Align() != test.align || ct.FieldAlign() != test.falign {
+			t.Errorf("%s %T: size/align/field align %d/%d/%d, want %d/%d/%d",
+				test.abi, test.v, ct.Size(), ct.Align(), ct.FieldAlign(),
+				test.size, test.align, test.falign)
+		}
+	}
+}
+
+type (
+	test_conc struct {
+		A [4]test_conc_in
+		P *test_conc
+		S []test_conc_in
+	}
+	test_conc_in struct {
+		X [2]float64
+		N int16
+	}
+)
+
+// the types built concurrently are the same instances, once per ABI
+func TestTypeOfConcurrent(t *testing.T) {
+	abis := []*ABI{Host, LP64, I386, I386.WithPack(2)}
+	values := []interface{}{test_conc{}, test_conc_in{}, [3]test_conc{}}
+	const n = 8
+	types := make([][]Type, n)
+	var wg sync.WaitGroup
+	for i := range types {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, abi := range abis {
+				for _, v := range values {
+					types[i] = append(types[i], abi.TypeOf(v))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 1; i < n; i++ {
+		for j, ct := range types[i] {
+			if ct != types[0][j] {
+				t.Errorf("%v: goroutine %d got another instance", ct, i)
+			}
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,123 @@
+package ctypes
+
+/*
+ #include <stdlib.h>
+*/
+import "C"
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// DefaultArenaBlockSize is the size of the C blocks of an Arena
+// created with a block size <= 0
+const DefaultArenaBlockSize = 64 << 10
+
+// arena_align is the alignment of the allocations of an Arena,
+// suitable for any C scalar (as malloc does)
+const arena_align = 16
+
+// An Arena hands out Values whose buffers, C-strings and deep-copied
+// slices and pointed-to values are carved out of large blocks of C memory,
+// all released at once by Free: it saves the malloc/free calls and the
+// finalizers of Values created one by one, when encoding lots of them.
+//
+// The Values of an Arena are C-heap Values (see NewC): they only hold
+// C pointers. Encoding one again does not reclaim the memory of its
+// previous payloads, until the Arena is freed.
+// An Arena is not safe for concurrent use.
+type Arena struct {
+	blocks []unsafe.Pointer // the C blocks of the arena
+	cur    unsafe.Pointer   // the block being carved out
+	off    uintptr          // the offset of the free space of cur
+	size   uintptr          // the size of cur
+	bsize  uintptr          // the size of a block
+	gen    int              // incremented by Free, to detect the use of freed Values
+}
+
+// NewArena returns an empty Arena allocating C blocks of blocksize bytes,
+// or of DefaultArenaBlockSize if blocksize <= 0.
+func NewArena(blocksize int) *Arena {
+	if blocksize <= 0 {
+		blocksize = DefaultArenaBlockSize
+	}
+	return &Arena{bsize: uintptr(blocksize)}
+}
+
+// New returns a zeroed Value of type t allocated in the arena.
+func (a *Arena) New(t Type) *Value {
+	if t == nil {
+		panic("ctypes: Arena.New(nil)")
+	}
+	p := a.alloc(t.Size())
+	return &Value{
+		b:       c_bytes(p, t.Size()),
+		t:       t,
+		abi:     t.ABI(),
+		idx:     0,
+		cbuf:    p,
+		foreign: true,
+		arena:   a,
+		agen:    a.gen,
+	}
+}
+
+// ValueOf is like ValueOf but allocates the Value in the arena.
+func (a *Arena) ValueOf(v interface{}) *Value {
+	rv := follow_ptr(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		panic(&UnsupportedTypeError{})
+	}
+	ct, err := Host.ctype_of(rv.Type())
+	if err != nil {
+		panic(err)
+	}
+	return a.New(ct)
+}
+
+// Free releases all the C memory of the arena at once.
+// The Values handed out so far can not be encoded nor decoded anymore:
+// ErrClosed is returned. The arena can be used again afterwards.
+func (a *Arena) Free() {
+	for _, p := range a.blocks {
+		C.free(p)
+	}
+	a.blocks = nil
+	a.cur = nil
+	a.off = 0
+	a.size = 0
+	a.gen++
+}
+
+// alloc returns n zeroed bytes of C memory from the arena
+func (a *Arena) alloc(n uintptr) unsafe.Pointer {
+	n = align_up(n, arena_align)
+	if n == 0 {
+		n = arena_align
+	}
+	if n > a.bsize/4 {
+		// too large to be carved out of a block: give it its own
+		return a.new_block(n)
+	}
+	if a.off+n > a.size {
+		a.cur = a.new_block(a.bsize)
+		a.off = 0
+		a.size = a.bsize
+	}
+	p := unsafe.Pointer(uintptr(a.cur) + a.off)
+	a.off += n
+	return p
+}
+
+// new_block allocates a zeroed block of n bytes of C memory
+func (a *Arena) new_block(n uintptr) unsafe.Pointer {
+	p := C.calloc(1, C.size_t(n))
+	if p == nil {
+		panic("ctypes: out of C memory")
+	}
+	a.blocks = append(a.blocks, p)
+	return p
+}
+
+// EOF
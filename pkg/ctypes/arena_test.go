@@ -0,0 +1,62 @@
+package ctypes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestArena(t *testing.T) {
+	a := NewArena(256)
+	for round := 0; round < 2; round++ {
+		// more values than a block holds, and one larger than a block
+		var vals []*Value
+		var ins []test_cval
+		for i := 0; i < 20; i++ {
+			in := test_cval{"hello", make([]int32, i+1), &test_cval_in{float64(i), "world"}}
+			if i == 10 {
+				in.Xs = make([]int32, 1000)
+			}
+			v := a.ValueOf(&in)
+			encode(t, v, &in)
+			if addr := uintptr(v.UnsafeAddress()); addr%arena_align != 0 {
+				t.Errorf("value %d at %#x, not aligned on %d", i, addr, arena_align)
+			}
+			vals = append(vals, v)
+			ins = append(ins, in)
+		}
+		for i, v := range vals {
+			var out test_cval
+			decode(t, v, &out)
+			if !reflect.DeepEqual(out, ins[i]) {
+				t.Errorf("value %d: decoded %+v, want %+v", i, out, ins[i])
+			}
+		}
+
+		// freeing the arena closes its Values, and it can be used again
+		a.Free()
+		for i, v := range vals {
+			if v.UnsafeAddress() != nil || v.Buffer() != nil {
+				t.Errorf("value %d: freed Value still has a buffer", i)
+			}
+			var out test_cval
+			if _, err := NewDecoder(v).Decode(&out); err != ErrClosed {
+				t.Errorf("value %d: Decode got %v, want ErrClosed", i, err)
+			}
+			if _, err := NewEncoder(v).Encode(&ins[i]); err != ErrClosed {
+				t.Errorf("value %d: Encode got %v, want ErrClosed", i, err)
+			}
+		}
+	}
+}
+
+func TestArenaError(t *testing.T) {
+	defer func() {
+		const msg = "ctypes: unsupported type [map[string]int] for field test_bad.In.M"
+		if r, ok := recover().(error); !ok || r.Error() != msg {
+			t.Errorf("Arena.ValueOf: panicked with %v, want %q", r, msg)
+		}
+	}()
+	NewArena(0).ValueOf(&test_bad{})
+}
+
+// EOF
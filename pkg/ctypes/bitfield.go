@@ -0,0 +1,112 @@
+package ctypes
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strconv"
+)
+
+// is_integer returns whether the Go type t is an integer or a boolean,
+// which can be stored in a bit-field or drive a union
+func is_integer(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// int_of returns the value of the integer or boolean rv
+func int_of(rv reflect.Value) int64 {
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1
+		}
+		return 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	}
+	return int64(rv.Uint())
+}
+
+// set_int stores x into the integer or boolean rv
+func set_int(rv reflect.Value, x int64) {
+	dst := writable(rv)
+	switch rv.Kind() {
+	case reflect.Bool:
+		dst.SetBool(x != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		dst.SetInt(x)
+	default:
+		dst.SetUint(uint64(x))
+	}
+}
+
+// bit_width returns the width of the bit-field declared by the ctypes
+// tag of the struct field f, or -1 if f is not a bit-field
+func bit_width(f reflect.StructField, cf Type) int {
+	s, ok := parse_tag(f.Tag)["bits"]
+	if !ok {
+		return -1
+	}
+	w, err := strconv.Atoi(s)
+	if err != nil || w < 0 {
+		tag_error(f.Tag, "invalid bit-field width [%s]", s)
+	}
+	if !is_integer(f.Type) {
+		tag_error(f.Tag, "bit-field of non-integer type [%v]", f.Type)
+	}
+	if w > 8*int(cf.Size()) {
+		tag_error(f.Tag, "bit-field wider than its type [%v]", f.Type)
+	}
+	if w == 0 && f.Name != "_" {
+		tag_error(f.Tag, "zero-width bit-field must be blank")
+	}
+	return w
+}
+
+// bit_shift returns the position of the lowest bit of the bit-field sf
+// within its storage unit: bit-fields are allocated from the least
+// significant bit on little-endian targets, from the most significant
+// one on big-endian targets (as GCC does.)
+func bit_shift(v *Value, sf *StructField) uint {
+	if v.byte_order() == binary.BigEndian {
+		return uint(8*sf.Type.Size() - sf.BitOffset - sf.BitSize)
+	}
+	return uint(sf.BitOffset)
+}
+
+// encode_bits stores the integer rv into the bit-field sf of the storage
+// unit at the cursor, leaving the other bits of that unit as they are
+func encode_bits(v *Value, rv reflect.Value, sf *StructField) {
+	n := int(sf.Type.Size())
+	base := v.idx
+	unit := v.get_uint(n)
+	shift := bit_shift(v, sf)
+	mask := uint64(1)<<sf.BitSize - 1
+	unit = unit&^(mask<<shift) | (uint64(int_of(rv))&mask)<<shift
+	v.idx = base
+	v.put_uint(unit, n)
+}
+
+// decode_bits loads the bit-field sf of the storage unit at the cursor
+// into the integer rv, sign-extending it if the C type of sf is signed
+func decode_bits(v *Value, rv reflect.Value, sf *StructField) {
+	n := int(sf.Type.Size())
+	unit := v.get_uint(n)
+	shift := bit_shift(v, sf)
+	mask := uint64(1)<<sf.BitSize - 1
+	x := int64((unit >> shift) & mask)
+	switch sf.Type.Kind() {
+	case Int, Int8, Int16, Int32, Int64:
+		pad := 64 - uint(sf.BitSize)
+		x = x << pad >> pad
+	}
+	set_int(rv, x)
+}
+
+// EOF
@@ -0,0 +1,80 @@
+package ctypes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+type ref_bits struct {
+	A uint32 `ctypes:"bits=3"`
+	B uint32 `ctypes:"bits=7"`
+	C int32  `ctypes:"bits=5"`
+	_ uint32 `ctypes:"bits=0"`
+	D uint8
+	E uint16 `ctypes:"bits=9"`
+	F uint16 `ctypes:"bits=9"`
+	G uint64 `ctypes:"bits=40"`
+}
+
+// the bytes of bit-fields are the ones of the C compiler
+func TestBitFields(t *testing.T) {
+	ct := TypeOf(ref_bits{})
+	if ct.Align() != cref.BitsAlign {
+		t.Errorf("align %d, want %d", ct.Align(), cref.BitsAlign)
+	}
+	for _, b := range []cref.Bits{
+		{},
+		{A: 5, B: 100, C: -3, D: 0xff, E: 300, F: 511, G: 1<<40 - 2},
+		{A: 7, B: 127, C: 15, D: 1, E: 1, F: 256, G: 0xdeadbeef},
+		{C: -16},
+	} {
+		in := ref_bits{A: b.A, B: b.B, C: b.C, D: b.D, E: b.E, F: b.F, G: b.G}
+		v := ValueOf(&in)
+		encode(t, v, &in)
+		if want := b.Image(); !bytes.Equal(v.Buffer(), want) {
+			t.Errorf("%+v: encoded % x, want % x", b, v.Buffer(), want)
+		}
+		var out ref_bits
+		decode(t, v, &out)
+		if out != in {
+			t.Errorf("%+v: decoded %+v", in, out)
+		}
+	}
+
+	// the values too wide for their bit-fields are truncated
+	in := ref_bits{A: 9, C: 17}
+	v := ValueOf(&in)
+	encode(t, v, &in)
+	var out ref_bits
+	decode(t, v, &out)
+	if out.A != 1 || out.C != -15 {
+		t.Errorf("truncated bit-fields decoded as %d, %d, want 1, -15", out.A, out.C)
+	}
+}
+
+func TestBitFieldErrors(t *testing.T) {
+	for _, v := range []interface{}{
+		struct {
+			A uint8 `ctypes:"bits=9"`
+		}{},
+		struct {
+			A float32 `ctypes:"bits=3"`
+		}{},
+		struct {
+			A uint8 `ctypes:"bits=0"`
+		}{},
+		struct {
+			A uint8 `ctypes:"bits=x"`
+		}{},
+	} {
+		if _, err := TypeOfErr(v); err == nil {
+			t.Errorf("%T: no error", v)
+		} else if _, ok := err.(*StructTagError); !ok {
+			t.Errorf("%T: got %v, want a *StructTagError", v, err)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,616 @@
+package ctypes
+
+/*
+ #include <string.h>
+ #include "call.h"
+
+ // ctypes_call calls fn with all the integer and SSE argument registers
+ // loaded from gp and sse, and the CTYPES_NSTACK words of st pushed on the
+ // stack. fn is called through a variadic prototype, so that %al is set
+ // to 8: the upper bound of the SSE registers used, as expected by the
+ // variadic functions (and ignored by the others.)
+ #define CTYPES_ARGS(T) \
+	 ((T(*)(uint64_t, ...))fn)( \
+		 gp[0], gp[1], gp[2], gp[3], gp[4], gp[5], \
+		 x[0], x[1], x[2], x[3], x[4], x[5], x[6], x[7], \
+		 st[0], st[1], st[2], st[3], st[4], st[5], st[6], st[7], \
+		 st[8], st[9], st[10], st[11], st[12], st[13], st[14], st[15])
+
+ static void ctypes_call(void* fn, uint64_t* gp, uint64_t* sse, uint64_t* st,
+						 int ret, uint64_t* out) {
+	 double x[CTYPES_NSSE];
+	 memcpy(x, sse, sizeof(x));
+	 switch (ret) {
+	 case CTYPES_RET_SS: {
+		 ctypes_ret_ss r = CTYPES_ARGS(ctypes_ret_ss);
+		 memcpy(&out[0], &r.a, 8);
+		 memcpy(&out[1], &r.b, 8);
+		 break;
+	 }
+	 case CTYPES_RET_IS: {
+		 ctypes_ret_is r = CTYPES_ARGS(ctypes_ret_is);
+		 out[0] = r.a;
+		 memcpy(&out[1], &r.b, 8);
+		 break;
+	 }
+	 case CTYPES_RET_SI: {
+		 ctypes_ret_si r = CTYPES_ARGS(ctypes_ret_si);
+		 memcpy(&out[0], &r.a, 8);
+		 out[1] = r.b;
+		 break;
+	 }
+	 default: {
+		 ctypes_ret_ii r = CTYPES_ARGS(ctypes_ret_ii);
+		 out[0] = r.a;
+		 out[1] = r.b;
+	 }
+	 }
+ }
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	call_ngp    = int(C.CTYPES_NGP)
+	call_nsse   = int(C.CTYPES_NSSE)
+	call_nstack = int(C.CTYPES_NSTACK)
+)
+
+// the class of an eightbyte of an argument or a return value,
+// as for the SysV x86-64 ABI
+type arg_class int
+
+const (
+	class_void arg_class = iota // no value
+	class_int                   // signed integers, sign-extended in a general purpose register
+	class_uint                  // unsigned integers, pointers and the integers of aggregates
+	class_sse                   // floating point values, in a SSE register
+)
+
+// arg_layout is how a value of a C type is passed to, or returned by,
+// a C function
+type arg_layout struct {
+	size    uintptr
+	align   uintptr
+	classes []arg_class // the class of each eightbyte of the value
+	mem     bool        // whether the value is passed in memory instead
+}
+
+// words returns the number of eightbytes of the value
+func (l *arg_layout) words() int {
+	return int(align_up(l.size, 8) / 8)
+}
+
+// layout_of returns the layout of a value of the C type t
+func layout_of(t Type) (*arg_layout, error) {
+	if !t.ABI().host_pointers() || t.ABI().types_root() != Host.types_root() {
+		return nil, fmt.Errorf("ctypes: %s is not laid out for the Host ABI", t)
+	}
+	l := &arg_layout{size: t.Size(), align: uintptr(t.Align())}
+	switch t.(type) {
+	case *cstruct_type, *cunion_type:
+		// aggregates larger than 2 eightbytes are passed in memory
+		if l.size > 16 {
+			l.mem = true
+			return l, nil
+		}
+		l.classes = make([]arg_class, l.words())
+		l.mem = !l.classify(t, 0)
+		for i, c := range l.classes {
+			if c == class_void {
+				// an eightbyte of padding
+				l.classes[i] = class_sse
+			}
+		}
+		return l, nil
+	case *cchars_type, *carray_type, *vlarray_type:
+		// C arrays are passed as pointers to their first element
+		return nil, &UnsupportedTypeError{Type: t.GoType()}
+	}
+	c := scalar_class(t)
+	if c == class_void {
+		return nil, &UnsupportedTypeError{Type: t.GoType()}
+	}
+	if c == class_uint && is_signed(t.GoType()) {
+		c = class_int
+	}
+	l.classes = []arg_class{c}
+	return l, nil
+}
+
+// classify merges the classes of the scalars of the C value of type t at
+// offset off of an aggregate into the classes of its eightbytes.
+// It returns false if the aggregate has to be passed in memory, because
+// of a misaligned field.
+func (l *arg_layout) classify(t Type, off uintptr) bool {
+	switch t := t.(type) {
+	case *cstruct_type:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if is_zero_width(&f) {
+				// only a marker, maybe at the very end of the struct
+				continue
+			}
+			if !l.classify(f.Type, off+f.Offset) {
+				return false
+			}
+		}
+		return true
+	case *cunion_type:
+		for _, m := range t.members {
+			if !l.classify(m.Type, off) {
+				return false
+			}
+		}
+		return true
+	case *carray_type:
+		for i := 0; i < t.Len(); i++ {
+			if !l.classify(t.elem, off+uintptr(i)*t.elem.Size()) {
+				return false
+			}
+		}
+		return true
+	case *cchars_type:
+		for i := 0; i < t.n; i++ {
+			l.merge(off+uintptr(i), class_uint)
+		}
+		return true
+	}
+	if off%uintptr(t.Align()) != 0 {
+		return false
+	}
+	l.merge(off, scalar_class(t))
+	return true
+}
+
+// is_zero_width returns whether f is a zero-width bit-field, which holds
+// no data
+func is_zero_width(f *StructField) bool {
+	return f.BitSize == 0 && f.Name == "_" &&
+		parse_tag(reflect.StructTag(f.Tag)).has("bits")
+}
+
+// merge merges the class c of the scalar at offset off into the class of
+// its eightbyte: integers win over floating point values
+func (l *arg_layout) merge(off uintptr, c arg_class) {
+	i := off / 8
+	if i >= uintptr(len(l.classes)) {
+		return
+	}
+	if l.classes[i] == class_void || c == class_uint {
+		l.classes[i] = c
+	}
+}
+
+// scalar_class returns the class of the scalar C type t, class_void if t
+// is not a scalar
+func scalar_class(t Type) arg_class {
+	switch t.GoType().Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr, reflect.Ptr, reflect.UnsafePointer, reflect.String:
+		return class_uint
+	case reflect.Float32, reflect.Float64:
+		return class_sse
+	}
+	return class_void
+}
+
+// is_signed returns whether t is a signed integer type
+func is_signed(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// call_gotype returns the Go type of the values of the C type t in calls:
+// complex numbers stand for their C structs
+func call_gotype(t Type) reflect.Type {
+	switch t.GoType() {
+	case g_complex64:
+		return reflect.TypeOf(complex64(0))
+	case g_complex128:
+		return reflect.TypeOf(complex128(0))
+	}
+	return t.GoType()
+}
+
+// signature is the C signature of a function
+type signature struct {
+	ret  Type          // the C type of the return value, nil for void
+	args []Type        // the C types of the arguments
+	rlay *arg_layout   // the layout of the return value, nil for void
+	alay []*arg_layout // the layouts of the arguments
+}
+
+// new_signature returns the signature of a C function returning a value
+// of type ret (nil for void) and taking arguments of types args
+func new_signature(ret Type, args []Type) (*signature, error) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("ctypes: calling C functions is not supported on %s/%s",
+			runtime.GOOS, runtime.GOARCH)
+	}
+	s := &signature{
+		ret:  ret,
+		args: append([]Type(nil), args...),
+		alay: make([]*arg_layout, len(args)),
+	}
+	var fr call_frame
+	if ret != nil {
+		l, err := layout_of(ret)
+		if err != nil {
+			return nil, err
+		}
+		s.rlay = l
+		if l.mem {
+			fr.push(ptr_layout, []uint64{0})
+		}
+	}
+	for i, t := range args {
+		if t == nil {
+			return nil, fmt.Errorf("ctypes: nil type for argument %d", i)
+		}
+		l, err := layout_of(t)
+		if err != nil {
+			return nil, err
+		}
+		s.alay[i] = l
+		if err = fr.push(l, make([]uint64, l.words())); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// A Func is a C function, called with Go values converted to the C types
+// of its signature.
+// It only supports the SysV x86-64 calling convention, for now.
+type Func struct {
+	signature
+	fn     unsafe.Pointer // the address of the C function
+	vararg bool           // whether the function is variadic
+}
+
+// NewFunc returns the C function at address fn (see Library.Lookup),
+// returning a value of type ret (nil for void) and taking arguments of
+// types args. Integers, floating point values, pointers, C-strings,
+// complex numbers, structs and unions are supported, laid out for the
+// Host ABI. Structs and unions are passed and returned by value.
+func NewFunc(fn unsafe.Pointer, ret Type, args ...Type) (*Func, error) {
+	if fn == nil {
+		return nil, fmt.Errorf("ctypes: NewFunc(nil)")
+	}
+	sig, err := new_signature(ret, args)
+	if err != nil {
+		return nil, err
+	}
+	return &Func{signature: *sig, fn: fn}, nil
+}
+
+// NewVariadicFunc is like NewFunc for a variadic C function, like printf,
+// whose fixed arguments have the types args. The C types of the extra
+// arguments of each call are inferred from their Go values.
+func NewVariadicFunc(fn unsafe.Pointer, ret Type, args ...Type) (*Func, error) {
+	f, err := NewFunc(fn, ret, args...)
+	if err != nil {
+		return nil, err
+	}
+	f.vararg = true
+	return f, nil
+}
+
+// Call calls the C function with the arguments args, converted to the
+// C types of the signature, and returns the C return value converted to
+// a Go value of the Go type of the return type (nil for void.)
+// Numbers are converted to the Go type of their argument as needed,
+// complex numbers stand for the C complex types and nil gives a NULL
+// pointer or C-string.
+// The C-strings of the arguments, and the values their Go pointers and
+// slices point to, are copied into C memory only valid during the call:
+// C writes into Go memory through unsafe.Pointer arguments. The C values
+// returned through Go pointer types are copied into new Go values.
+//
+// The extra arguments of a variadic function are passed with the C type
+// of their Go value (see TypeOf), after the default argument promotions
+// of C: float32 is passed as a double, bool, int8, int16, uint8 and
+// uint16 as an int. Note that a Go int is a C long: printf's %d wants
+// an int32. nil is passed as a NULL pointer.
+func (f *Func) Call(args ...interface{}) (interface{}, error) {
+	switch {
+	case f.vararg && len(args) < len(f.args):
+		return nil, fmt.Errorf("ctypes: %d arguments for a C function taking at least %d",
+			len(args), len(f.args))
+	case !f.vararg && len(args) != len(f.args):
+		return nil, fmt.Errorf("ctypes: %d arguments for a C function taking %d",
+			len(args), len(f.args))
+	}
+	var fr call_frame
+	vals := make([]*Value, 0, len(args)+1)
+	defer func() {
+		for _, v := range vals {
+			v.Close()
+		}
+	}()
+
+	var rv *Value // the returned C value
+	if f.ret != nil {
+		rv = New(f.ret)
+		rv.SetDeepCopy(true)
+		vals = append(vals, rv)
+		if f.rlay.mem {
+			// the address of the returned value is a hidden first argument
+			addr := uint64(uintptr(unsafe.Pointer(&rv.b[0])))
+			fr.push(ptr_layout, []uint64{addr})
+		}
+	}
+	for i, a := range args {
+		var t Type
+		var l *arg_layout
+		if i < len(f.args) {
+			t, l = f.args[i], f.alay[i]
+		} else {
+			var err error
+			a = promote(a)
+			if t, err = TypeOfErr(a); err == nil {
+				l, err = layout_of(t)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("ctypes: argument %d: %v", i, err)
+			}
+		}
+		v, err := encode_arg(t, a)
+		if err != nil {
+			return nil, fmt.Errorf("ctypes: argument %d: %v", i, err)
+		}
+		vals = append(vals, v)
+		if err = fr.push(l, arg_words(v, l)); err != nil {
+			return nil, err
+		}
+	}
+
+	var out [2]uint64
+	C.ctypes_call(f.fn,
+		(*C.uint64_t)(unsafe.Pointer(&fr.gp[0])),
+		(*C.uint64_t)(unsafe.Pointer(&fr.sse[0])),
+		(*C.uint64_t)(unsafe.Pointer(&fr.st[0])),
+		C.int(ret_regs(f.rlay)),
+		(*C.uint64_t)(unsafe.Pointer(&out[0])))
+	// Go pointers are only held as integers in the frame
+	runtime.KeepAlive(args)
+
+	if f.ret == nil {
+		return nil, nil
+	}
+	if !f.rlay.mem {
+		set_words(rv, out[:])
+	}
+	return decode_call(rv)
+}
+
+// the layout of a pointer
+var ptr_layout = &arg_layout{size: 8, align: 8, classes: []arg_class{class_uint}}
+
+// ret_regs returns the registers holding the value of layout l returned
+// by a C function, as one of the CTYPES_RET_xx constants
+func ret_regs(l *arg_layout) int {
+	if l == nil || l.mem || len(l.classes) == 0 {
+		return C.CTYPES_RET_II
+	}
+	sse0 := l.classes[0] == class_sse
+	if len(l.classes) == 1 {
+		if sse0 {
+			return C.CTYPES_RET_SS
+		}
+		return C.CTYPES_RET_II
+	}
+	sse1 := l.classes[1] == class_sse
+	switch {
+	case sse0 && sse1:
+		return C.CTYPES_RET_SS
+	case sse0:
+		return C.CTYPES_RET_SI
+	case sse1:
+		return C.CTYPES_RET_IS
+	}
+	return C.CTYPES_RET_II
+}
+
+// the registers and stack words of a call
+type call_frame struct {
+	gp   [call_ngp]uint64    // rdi, rsi, rdx, rcx, r8, r9
+	sse  [call_nsse]uint64   // xmm0-xmm7
+	st   [call_nstack]uint64 // the arguments passed on the stack
+	ngp  int
+	nsse int
+	nst  int
+}
+
+// fits returns whether the eightbytes of a value of layout l are passed
+// in registers, given the ones already used
+func (fr *call_frame) fits(l *arg_layout) bool {
+	if l.mem {
+		return false
+	}
+	ngp, nsse := 0, 0
+	for _, c := range l.classes {
+		if c == class_sse {
+			nsse++
+		} else {
+			ngp++
+		}
+	}
+	return fr.ngp+ngp <= call_ngp && fr.nsse+nsse <= call_nsse
+}
+
+// stack returns the index of the first stack word of a value of layout l
+// passed on the stack, or -1 if there are not enough words left
+func (fr *call_frame) stack(l *arg_layout) int {
+	n := fr.nst
+	if l.align > 8 {
+		n = int(align_up(uintptr(n), l.align/8))
+	}
+	if n+l.words() > call_nstack {
+		return -1
+	}
+	fr.nst = n + l.words()
+	return n
+}
+
+// push assigns the eightbytes words of a value of layout l to the next
+// free registers of their classes, or to the stack if they do not all
+// fit in registers
+func (fr *call_frame) push(l *arg_layout, words []uint64) error {
+	if fr.fits(l) {
+		for i, c := range l.classes {
+			if c == class_sse {
+				fr.sse[fr.nsse] = words[i]
+				fr.nsse++
+			} else {
+				fr.gp[fr.ngp] = words[i]
+				fr.ngp++
+			}
+		}
+		return nil
+	}
+	n := fr.stack(l)
+	if n < 0 {
+		return fmt.Errorf("ctypes: too many arguments passed on the stack (max %d words)",
+			call_nstack)
+	}
+	copy(fr.st[n:], words)
+	return nil
+}
+
+// pop returns the eightbytes of the next value of layout l received in
+// the frame, as assigned by push
+func (fr *call_frame) pop(l *arg_layout) []uint64 {
+	words := make([]uint64, l.words())
+	if fr.fits(l) {
+		for i, c := range l.classes {
+			if c == class_sse {
+				words[i] = fr.sse[fr.nsse]
+				fr.nsse++
+			} else {
+				words[i] = fr.gp[fr.ngp]
+				fr.ngp++
+			}
+		}
+		return words
+	}
+	if n := fr.stack(l); n >= 0 {
+		copy(words, fr.st[n:])
+	}
+	return words
+}
+
+// encode_arg returns the C value of the argument a of C type t
+func encode_arg(t Type, a interface{}) (v *Value, err error) {
+	gt := call_gotype(t)
+	rv := reflect.ValueOf(a)
+	switch {
+	case !rv.IsValid():
+		rv = reflect.Zero(gt)
+	case rv.Type() != gt && is_number(rv.Type()) && is_number(gt):
+		rv = rv.Convert(gt)
+	case rv.Type() != gt && is_complex(rv.Type()) && is_complex(gt):
+		rv = rv.Convert(gt)
+	case rv.Type() != gt && is_number(rv.Type()) && is_complex(gt):
+		re := rv.Convert(reflect.TypeOf(float64(0))).Float()
+		rv = reflect.ValueOf(complex(re, 0)).Convert(gt)
+	case rv.Type() != gt:
+		return nil, fmt.Errorf("cannot encode this type [%s]", rv.Type())
+	}
+	// the encoder needs an addressable value
+	arg := reflect.New(gt).Elem()
+	arg.Set(rv)
+
+	// pointed-to values and slices are copied into C memory, owned by v
+	v = New(t)
+	v.SetDeepCopy(true)
+	defer catch_error(gt, &err)
+	v.track_pointers(arg)
+	defer v.untrack_pointers()
+	encode_value(v, arg)
+	return v, nil
+}
+
+// promote returns the Go value standing for the variadic argument a,
+// after the default argument promotions of C
+func promote(a interface{}) interface{} {
+	rv := reflect.ValueOf(a)
+	if !rv.IsValid() {
+		return unsafe.Pointer(nil)
+	}
+	switch rv.Kind() {
+	case reflect.Float32:
+		return rv.Float()
+	case reflect.Bool:
+		if rv.Bool() {
+			return int32(1)
+		}
+		return int32(0)
+	case reflect.Int8, reflect.Int16:
+		return int32(rv.Int())
+	case reflect.Uint8, reflect.Uint16:
+		return int32(rv.Uint())
+	}
+	return a
+}
+
+// is_complex returns whether t is a complex number type
+func is_complex(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Complex64, reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+// arg_words returns the eightbytes of the C value v of layout l
+func arg_words(v *Value, l *arg_layout) []uint64 {
+	if len(l.classes) > 0 && l.classes[0] == class_int {
+		v.idx = 0
+		return []uint64{uint64(v.get_int(int(l.size)))}
+	}
+	b := make([]byte, l.words()*8)
+	copy(b, v.b)
+	words := make([]uint64, l.words())
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return words
+}
+
+// set_words sets the bytes of the C value v from its eightbytes words
+func set_words(v *Value, words []uint64) {
+	b := make([]byte, 8*len(words))
+	for i, w := range words {
+		binary.LittleEndian.PutUint64(b[8*i:], w)
+	}
+	copy(v.b, b)
+}
+
+// decode_call returns the Go value of the C value v, passed to or
+// returned by a C function
+func decode_call(v *Value) (r interface{}, err error) {
+	gt := call_gotype(v.t)
+	rv := reflect.New(gt).Elem()
+	defer catch_error(gt, &err)
+	v.idx = 0
+	v.track_pointers(rv)
+	defer v.untrack_pointers()
+	decode_value(v, rv)
+	return rv.Interface(), nil
+}
+
+// EOF
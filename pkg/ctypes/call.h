@@ -0,0 +1,33 @@
+#ifndef CTYPES_CALL_H
+#define CTYPES_CALL_H 1
+
+#include <stdint.h>
+
+// the argument registers and stack words of the calls of C functions
+#define CTYPES_NGP    6
+#define CTYPES_NSSE   8
+#define CTYPES_NSTACK 16
+
+// the number of Go callbacks which can be exposed at the same time
+#define CTYPES_NCALLBACKS 64
+
+// the 2 return registers of a call, as rax:rdx, xmm0:xmm1, rax:xmm0
+// or xmm0:rax depending on the classes of the returned eightbytes
+typedef struct { uint64_t a, b; } ctypes_ret_ii;
+typedef struct { double   a, b; } ctypes_ret_ss;
+typedef struct { uint64_t a; double b; } ctypes_ret_is;
+typedef struct { double a; uint64_t b; } ctypes_ret_si;
+
+enum {
+	CTYPES_RET_II = 0,
+	CTYPES_RET_SS = 1,
+	CTYPES_RET_IS = 2,
+	CTYPES_RET_SI = 3,
+	CTYPES_NRET   = 4,
+};
+
+// ctypes_callback returns the trampoline of the callback slot, returning
+// its value in the registers ret (one of the CTYPES_RET_xx constants)
+extern void* ctypes_callback(int slot, int ret);
+
+#endif /* !CTYPES_CALL_H */
@@ -0,0 +1,264 @@
+package ctypes
+
+import (
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func skip_calls(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skipf("C calls are not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+}
+
+func load_library(t *testing.T, name string) *Library {
+	skip_calls(t)
+	lib, err := LoadLibrary(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib
+}
+
+func new_func(t *testing.T, lib *Library, name string, ret Type, args ...Type) *Func {
+	sym, err := lib.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFunc(sym, ret, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return f
+}
+
+func check_call(t *testing.T, name string, f *Func, want interface{}, args ...interface{}) {
+	got, err := f.Call(args...)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v (%T), want %v (%T)", name, got, got, want, want)
+	}
+}
+
+var (
+	t_int8    = TypeOf(int8(0))
+	t_int32   = TypeOf(int32(0))
+	t_int64   = TypeOf(int64(0))
+	t_uint64  = TypeOf(uint64(0))
+	t_float32 = TypeOf(float32(0))
+	t_float64 = TypeOf(float64(0))
+	t_string  = TypeOf("")
+	t_ptr     = TypeOf(unsafe.Pointer(nil))
+)
+
+func TestCallScalars(t *testing.T) {
+	libc := load_library(t, "libc.so.6")
+	libm := load_library(t, "libm.so.6")
+
+	strlen := new_func(t, libc, "strlen", t_uint64, t_string)
+	check_call(t, "strlen", strlen, uint64(12), "hello, world")
+	abs := new_func(t, libc, "abs", t_int32, t_int32)
+	check_call(t, "abs", abs, int32(5), -5)
+	strtol := new_func(t, libc, "strtol", t_int64, t_string, t_ptr, t_int32)
+	check_call(t, "strtol", strtol, int64(-31), "-0x1f", nil, 16)
+	cos := new_func(t, libm, "cos", t_float64, t_float64)
+	check_call(t, "cos", cos, math.Cos(0.5), 0.5)
+	sqrtf := new_func(t, libm, "sqrtf", t_float32, t_float32)
+	check_call(t, "sqrtf", sqrtf, float32(1.5), 2.25)
+}
+
+func TestCallErrors(t *testing.T) {
+	libc := load_library(t, "libc.so.6")
+	sym, err := libc.Lookup("abs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		ret  Type
+		args []Type
+	}{
+		{"nil argument", t_int32, []Type{nil}},
+		{"foreign ABI", t_int32, []Type{ILP32.TypeOf(int32(0))}},
+		{"array", t_int32, []Type{TypeOf([2]int32{})}},
+		{"slice", TypeOf([]int32{}), nil},
+		{"too many words", nil, []Type{
+			t_int64, t_int64, t_int64, t_int64, t_int64, t_int64,
+			t_int64, t_int64, t_int64, t_int64, t_int64, t_int64,
+			t_int64, t_int64, t_int64, t_int64, t_int64, t_int64,
+			t_int64, t_int64, t_int64, t_int64, t_int64}},
+	} {
+		if _, err := NewFunc(sym, test.ret, test.args...); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	abs := new_func(t, libc, "abs", t_int32, t_int32)
+	for _, args := range [][]interface{}{
+		{},
+		{1, 2},
+		{"1"},
+		{1.5i},
+	} {
+		if _, err := abs.Call(args...); err == nil {
+			t.Errorf("abs%v: no error", args)
+		}
+	}
+}
+
+// the extra arguments take the C type of their Go value, once promoted
+func TestCallVariadic(t *testing.T) {
+	libc := load_library(t, "libc.so.6")
+	sym, err := libc.Lookup("snprintf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snprintf, err := NewVariadicFunc(sym, t_int32, t_ptr, t_uint64, t_string)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 128)
+	for _, test := range []struct {
+		format, want string
+		args         []interface{}
+	}{
+		{"no argument", "no argument", nil},
+		// 8 doubles go in registers, the 9th on the stack
+		{"%d %d %d %d|%g %g %g %g %g %g %g %g %g|%s", "1 2 3 4|1 2 3 4 5 6 7 8 9.5|end",
+			[]interface{}{int32(1), int16(2), int8(3), int32(4),
+				1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, float32(9.5), "end"}},
+		{"%d %d %d %d %d|%ld", "-1 -2 255 1 0|-3",
+			[]interface{}{int8(-1), int16(-2), uint8(255), true, false, -3}},
+		{"%p %u", "(nil) 4294967295", []interface{}{nil, uint32(math.MaxUint32)}},
+	} {
+		args := append([]interface{}{unsafe.Pointer(&buf[0]), uint64(len(buf)), test.format}, test.args...)
+		n, err := snprintf.Call(args...)
+		if err != nil {
+			t.Errorf("%q: %v", test.format, err)
+			continue
+		}
+		if got := string(buf[:n.(int32)]); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.format, got, test.want)
+		}
+	}
+
+	for _, args := range [][]interface{}{
+		{unsafe.Pointer(&buf[0]), uint64(len(buf))},
+		{unsafe.Pointer(&buf[0]), uint64(len(buf)), "%d", make(chan int)},
+	} {
+		if _, err := snprintf.Call(args...); err == nil {
+			t.Errorf("snprintf%v: no error", args)
+		}
+	}
+}
+
+type test_zero_width struct {
+	A uint64 `ctypes:"bits=3"`
+	_ uint64 `ctypes:"bits=0"`
+}
+
+// the classes of the eightbytes of aggregates, as gcc assigns them
+func TestCallLayout(t *testing.T) {
+	const (
+		i = class_uint
+		f = class_sse
+	)
+	for _, test := range []struct {
+		v       interface{}
+		abi     *ABI
+		classes []arg_class
+		mem     bool
+	}{
+		{struct{ X, Y float64 }{}, Host, []arg_class{f, f}, false},
+		{struct {
+			A int32
+			F float32
+		}{}, Host, []arg_class{i}, false},
+		{struct {
+			F, G float32
+			D    float64
+		}{}, Host, []arg_class{f, f}, false},
+		{struct {
+			C int8
+			D float64
+		}{}, Host, []arg_class{i, f}, false},
+		{struct{ A [3]int64 }{}, Host, nil, true},
+		{ref_variant{}, Host, []arg_class{i, i}, false},
+		{ref_packed1{}, Host.WithPack(1), nil, true},
+		{complex64(0), Host, []arg_class{f}, false},
+		{test_zero_width{}, Host, []arg_class{i}, false},
+		{struct{}{}, Host, []arg_class{}, false},
+	} {
+		l, err := layout_of(test.abi.TypeOf(test.v))
+		if err != nil {
+			t.Errorf("%T: %v", test.v, err)
+			continue
+		}
+		if l.mem != test.mem || (!l.mem && !reflect.DeepEqual(l.classes, test.classes)) {
+			t.Errorf("%T: classes %v (in memory: %v), want %v (%v)",
+				test.v, l.classes, l.mem, test.classes, test.mem)
+		}
+	}
+}
+
+type test_div struct {
+	Quot, Rem int32
+}
+
+func TestCallStructByValue(t *testing.T) {
+	libc := load_library(t, "libc.so.6")
+	libm := load_library(t, "libm.so.6")
+
+	div := new_func(t, libc, "div", TypeOf(test_div{}), t_int32, t_int32)
+	check_call(t, "div", div, test_div{3, 2}, 17, 5)
+	check_call(t, "div", div, test_div{-3, -2}, -17, 5)
+	ldiv := new_func(t, libc, "ldiv", TypeOf(struct{ Quot, Rem int }{}), t_int64, t_int64)
+	check_call(t, "ldiv", ldiv, struct{ Quot, Rem int }{-3, -2}, -17, 5)
+
+	// complex numbers are structs of 2 floating point values
+	t_complex64 := TypeOf(complex64(0))
+	t_complex128 := TypeOf(complex128(0))
+	cabs := new_func(t, libm, "cabs", t_float64, t_complex128)
+	check_call(t, "cabs", cabs, 5.0, 3+4i)
+	cabsf := new_func(t, libm, "cabsf", t_float32, t_complex64)
+	check_call(t, "cabsf", cabsf, float32(5), complex64(3+4i))
+	csqrt := new_func(t, libm, "csqrt", t_complex128, t_complex128)
+	check_call(t, "csqrt", csqrt, 2i, -4)
+	conjf := new_func(t, libm, "conjf", t_complex64, t_complex64)
+	check_call(t, "conjf", conjf, complex64(1-2i), complex64(1+2i))
+
+	// an empty struct takes no register
+	abs := new_func(t, libc, "abs", t_int32, TypeOf(struct{}{}), t_int32)
+	check_call(t, "abs", abs, int32(3), struct{}{}, -3)
+}
+
+// a struct as large as a pointer stands for it
+type (
+	test_chars struct {
+		P *[3]uint8
+	}
+	test_bytes struct {
+		P *[6]uint8
+	}
+)
+
+// the pointers of arguments and return values are copied to and from C
+func TestCallPointers(t *testing.T) {
+	libc := load_library(t, "libc.so.6")
+
+	strlen := new_func(t, libc, "strlen", t_uint64, TypeOf(test_bytes{}))
+	check_call(t, "strlen", strlen, uint64(5), test_bytes{&[6]uint8{'h', 'e', 'l', 'l', 'o'}})
+	strchr := new_func(t, libc, "strchr", TypeOf(&[3]uint8{}), t_string, t_int32)
+	check_call(t, "strchr", strchr, &[3]uint8{'l', 'l', 'o'}, "hello", 'l')
+	check_call(t, "strchr", strchr, (*[3]uint8)(nil), "hello", 'x')
+	strchr = new_func(t, libc, "strchr", TypeOf(test_chars{}), t_string, t_int32)
+	check_call(t, "strchr", strchr, test_chars{&[3]uint8{'e', 'l', 'l'}}, "hello", 'e')
+}
+
+// EOF
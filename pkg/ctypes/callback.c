@@ -0,0 +1,87 @@
+#include <string.h>
+
+#include "call.h"
+#include "_cgo_export.h"
+
+// the trampolines of the callback slots take all the integer and SSE
+// argument registers and CTYPES_NSTACK words of the stack of the caller,
+// whatever the actual signature of the callback, and hand them to Go.
+#define CTYPES_CB_PARAMS \
+	uint64_t a0, uint64_t a1, uint64_t a2, uint64_t a3, uint64_t a4, uint64_t a5, \
+	double x0, double x1, double x2, double x3, \
+	double x4, double x5, double x6, double x7, \
+	uint64_t s0, uint64_t s1, uint64_t s2, uint64_t s3, \
+	uint64_t s4, uint64_t s5, uint64_t s6, uint64_t s7, \
+	uint64_t s8, uint64_t s9, uint64_t s10, uint64_t s11, \
+	uint64_t s12, uint64_t s13, uint64_t s14, uint64_t s15
+
+#define CTYPES_CB_BODY(slot) \
+	uint64_t gp[CTYPES_NGP] = {a0, a1, a2, a3, a4, a5}; \
+	double x[CTYPES_NSSE] = {x0, x1, x2, x3, x4, x5, x6, x7}; \
+	uint64_t st[CTYPES_NSTACK] = { \
+		s0, s1, s2, s3, s4, s5, s6, s7, \
+		s8, s9, s10, s11, s12, s13, s14, s15}; \
+	uint64_t sse[CTYPES_NSSE]; \
+	uint64_t out[2] = {0, 0}; \
+	memcpy(sse, x, sizeof(sse)); \
+	ctypes_go_callback(slot, gp, sse, st, out);
+
+#define CTYPES_CB(slot) \
+	static ctypes_ret_ii ctypes_cb_ii_##slot(CTYPES_CB_PARAMS) { \
+		ctypes_ret_ii r; \
+		CTYPES_CB_BODY(slot) \
+		r.a = out[0]; \
+		r.b = out[1]; \
+		return r; \
+	} \
+	static ctypes_ret_ss ctypes_cb_ss_##slot(CTYPES_CB_PARAMS) { \
+		ctypes_ret_ss r; \
+		CTYPES_CB_BODY(slot) \
+		memcpy(&r.a, &out[0], 8); \
+		memcpy(&r.b, &out[1], 8); \
+		return r; \
+	} \
+	static ctypes_ret_is ctypes_cb_is_##slot(CTYPES_CB_PARAMS) { \
+		ctypes_ret_is r; \
+		CTYPES_CB_BODY(slot) \
+		r.a = out[0]; \
+		memcpy(&r.b, &out[1], 8); \
+		return r; \
+	} \
+	static ctypes_ret_si ctypes_cb_si_##slot(CTYPES_CB_PARAMS) { \
+		ctypes_ret_si r; \
+		CTYPES_CB_BODY(slot) \
+		memcpy(&r.a, &out[0], 8); \
+		r.b = out[1]; \
+		return r; \
+	}
+
+#define CTYPES_CB_ENTRY(slot) { \
+	(void*)ctypes_cb_ii_##slot, \
+	(void*)ctypes_cb_ss_##slot, \
+	(void*)ctypes_cb_is_##slot, \
+	(void*)ctypes_cb_si_##slot, \
+},
+
+// the CTYPES_NCALLBACKS slots
+#define CTYPES_SLOTS(X) \
+	X(0)  X(1)  X(2)  X(3)  X(4)  X(5)  X(6)  X(7)  \
+	X(8)  X(9)  X(10) X(11) X(12) X(13) X(14) X(15) \
+	X(16) X(17) X(18) X(19) X(20) X(21) X(22) X(23) \
+	X(24) X(25) X(26) X(27) X(28) X(29) X(30) X(31) \
+	X(32) X(33) X(34) X(35) X(36) X(37) X(38) X(39) \
+	X(40) X(41) X(42) X(43) X(44) X(45) X(46) X(47) \
+	X(48) X(49) X(50) X(51) X(52) X(53) X(54) X(55) \
+	X(56) X(57) X(58) X(59) X(60) X(61) X(62) X(63)
+
+CTYPES_SLOTS(CTYPES_CB)
+
+static void* ctypes_callbacks[CTYPES_NCALLBACKS][CTYPES_NRET] = {
+	CTYPES_SLOTS(CTYPES_CB_ENTRY)
+};
+
+void* ctypes_callback(int slot, int ret) {
+	return ctypes_callbacks[slot][ret];
+}
+
+/* EOF */
@@ -0,0 +1,198 @@
+package ctypes
+
+/*
+ #include "call.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// A Callback is a Go function exposed to C as a function pointer: its C
+// arguments are converted to Go values and its Go return value to C, as
+// for the calls of a Func.
+// Only 64 callbacks can be exposed at the same time:
+// they have to be released by Close.
+type Callback struct {
+	signature
+	fn   reflect.Value  // the Go function
+	slot int            // the trampoline slot, -1 once closed
+	addr unsafe.Pointer // the address of the trampoline
+}
+
+// the callbacks of the trampoline slots
+var g_callbacks struct {
+	sync.RWMutex
+	slots [C.CTYPES_NCALLBACKS]*Callback
+}
+
+// NewCallback exposes the Go function fn as a C function returning a
+// value of type ret (nil for void) and taking arguments of types args.
+// The parameters and result of fn have the Go types of these C types, or
+// complex64 and complex128 for the C complex types, and fn must not panic.
+// The values returned by fn can not hold C-strings, Go pointers nor
+// slices, which are copied into C memory released before the C caller
+// gets it: such a return type is rejected.
+func NewCallback(fn interface{}, ret Type, args ...Type) (*Callback, error) {
+	sig, err := new_signature(ret, args)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		return nil, fmt.Errorf("ctypes: callback is not a func [%T]", fn)
+	}
+	if !callback_matches(rv.Type(), sig) {
+		return nil, fmt.Errorf("ctypes: callback of type %s does not match its C signature",
+			rv.Type())
+	}
+	if ret != nil && holds_payload(ret) {
+		// it would be released before the C caller gets it
+		return nil, fmt.Errorf("ctypes: callback can not return C-strings, pointers nor slices [%s]", ret)
+	}
+
+	cb := &Callback{signature: *sig, fn: rv, slot: -1}
+	g_callbacks.Lock()
+	defer g_callbacks.Unlock()
+	for i, c := range g_callbacks.slots {
+		if c == nil {
+			g_callbacks.slots[i] = cb
+			cb.slot = i
+			break
+		}
+	}
+	if cb.slot < 0 {
+		return nil, fmt.Errorf("ctypes: all the %d callbacks are in use", len(g_callbacks.slots))
+	}
+	cb.addr = C.ctypes_callback(C.int(cb.slot), C.int(ret_regs(sig.rlay)))
+	return cb, nil
+}
+
+// callback_matches returns whether the Go func type t matches sig
+func callback_matches(t reflect.Type, sig *signature) bool {
+	if t.IsVariadic() || t.NumIn() != len(sig.args) {
+		return false
+	}
+	for i, a := range sig.args {
+		if t.In(i) != call_gotype(a) {
+			return false
+		}
+	}
+	if sig.ret == nil {
+		return t.NumOut() == 0
+	}
+	return t.NumOut() == 1 && t.Out(0) == call_gotype(sig.ret)
+}
+
+// holds_payload returns whether a value of the C type t holds a C-string,
+// a Go pointer or a slice, itself or in its fields, members or elements:
+// their payloads are copied into C memory
+func holds_payload(t Type) bool {
+	switch t := t.(type) {
+	case *cstring_type, *vlarray_type:
+		return true
+	case *common_type:
+		return t.Kind() == Ptr
+	case *cstruct_type:
+		for i := 0; i < t.NumField(); i++ {
+			if holds_payload(t.Field(i).Type) {
+				return true
+			}
+		}
+	case *cunion_type:
+		for _, m := range t.members {
+			if holds_payload(m.Type) {
+				return true
+			}
+		}
+	case *carray_type:
+		return holds_payload(t.elem)
+	}
+	return false
+}
+
+// UnsafeAddress returns the address of the C function calling the
+// callback, nil once the callback is closed
+func (cb *Callback) UnsafeAddress() unsafe.Pointer {
+	g_callbacks.RLock()
+	defer g_callbacks.RUnlock()
+	if cb.slot < 0 {
+		return nil
+	}
+	return cb.addr
+}
+
+// Close releases the slot of the callback, which can not be called from
+// C anymore. Closing a Callback more than once is a no-op.
+func (cb *Callback) Close() error {
+	g_callbacks.Lock()
+	defer g_callbacks.Unlock()
+	if cb.slot < 0 {
+		return nil
+	}
+	g_callbacks.slots[cb.slot] = nil
+	cb.slot = -1
+	cb.addr = nil
+	return nil
+}
+
+//export ctypes_go_callback
+func ctypes_go_callback(slot C.int, gp, sse, st, out *C.uint64_t) {
+	g_callbacks.RLock()
+	cb := g_callbacks.slots[slot]
+	g_callbacks.RUnlock()
+	if cb == nil {
+		panic("ctypes: call of a closed Callback")
+	}
+	var fr call_frame
+	fr.gp = *(*[call_ngp]uint64)(unsafe.Pointer(gp))
+	fr.sse = *(*[call_nsse]uint64)(unsafe.Pointer(sse))
+	fr.st = *(*[call_nstack]uint64)(unsafe.Pointer(st))
+	*(*[2]uint64)(unsafe.Pointer(out)) = cb.call(&fr)
+}
+
+// call calls the Go function with the arguments received in fr, and
+// returns the registers of its return value
+func (cb *Callback) call(fr *call_frame) (out [2]uint64) {
+	var ret unsafe.Pointer // the memory of the returned value
+	if cb.rlay != nil && cb.rlay.mem {
+		words := fr.pop(ptr_layout)
+		ret = *(*unsafe.Pointer)(unsafe.Pointer(&words[0]))
+	}
+	in := make([]reflect.Value, len(cb.args))
+	for i, t := range cb.args {
+		v := New(t)
+		v.SetDeepCopy(true)
+		set_words(v, fr.pop(cb.alay[i]))
+		x, err := decode_call(v)
+		v.Close()
+		if err != nil {
+			panic(err)
+		}
+		in[i] = reflect.ValueOf(x)
+	}
+
+	res := cb.fn.Call(in)
+	if cb.ret == nil {
+		return
+	}
+	v, err := encode_arg(cb.ret, res[0].Interface())
+	if err != nil {
+		panic(err)
+	}
+	defer v.Close()
+	if cb.rlay.mem {
+		// the address of the returned value is returned in rax
+		copy(c_bytes(ret, cb.ret.Size()), v.b)
+		out[0] = uint64(uintptr(ret))
+		return
+	}
+	copy(out[:], arg_words(v, cb.rlay))
+	return
+}
+
+// EOF
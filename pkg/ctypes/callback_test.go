@@ -0,0 +1,157 @@
+package ctypes
+
+import (
+	"sort"
+	"testing"
+	"unsafe"
+)
+
+func new_callback(t *testing.T, fn interface{}, ret Type, args ...Type) *Callback {
+	cb, err := NewCallback(fn, ret, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cb
+}
+
+// call_back returns a Func calling the callback cb
+func call_back(t *testing.T, cb *Callback) *Func {
+	f, err := NewFunc(cb.UnsafeAddress(), cb.ret, cb.args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCallback(t *testing.T) {
+	skip_calls(t)
+
+	neg := new_callback(t, func(x int8) int8 { return -x }, t_int8, t_int8)
+	defer neg.Close()
+	check_call(t, "neg", call_back(t, neg), int8(-100), int8(100))
+	check_call(t, "neg", call_back(t, neg), int8(56), int8(-56))
+
+	// 6 integers and 8 floating point values go in registers, the others
+	// on the stack
+	sum := new_callback(t,
+		func(a, b, c, d, e, f, g int64, x0, x1, x2, x3, x4, x5, x6, x7 float64, y float32) float64 {
+			return float64(a+b+c+d+e+f+g) + x0 + x1 + x2 + x3 + x4 + x5 + x6 + x7 + float64(y)
+		},
+		t_float64,
+		t_int64, t_int64, t_int64, t_int64, t_int64, t_int64, t_int64,
+		t_float64, t_float64, t_float64, t_float64, t_float64, t_float64, t_float64, t_float64,
+		t_float32)
+	defer sum.Close()
+	check_call(t, "sum", call_back(t, sum), 28+36+9.5,
+		1, 2, 3, 4, 5, 6, 7, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, float32(9.5))
+
+	// void
+	var got int32
+	set := new_callback(t, func(x int32) { got = x }, nil, t_int32)
+	defer set.Close()
+	check_call(t, "set", call_back(t, set), nil, int32(42))
+	if got != 42 {
+		t.Errorf("set: got %d, want 42", got)
+	}
+}
+
+type test_big struct {
+	A, B, C int64
+	X       float64
+}
+
+// structs larger than 2 eightbytes are passed and returned in memory
+func TestCallStructInMemory(t *testing.T) {
+	skip_calls(t)
+
+	tbig := TypeOf(test_big{})
+	cb := new_callback(t, func(b test_big, k int64) test_big {
+		return test_big{b.A + k, b.B + k, b.C + k, b.X * 2}
+	}, tbig, tbig, t_int64)
+	defer cb.Close()
+	check_call(t, "big", call_back(t, cb), test_big{11, 12, 13, 5}, test_big{1, 2, 3, 2.5}, 10)
+}
+
+func TestCallbackQsort(t *testing.T) {
+	libc := load_library(t, "libc.so.6")
+
+	cmp := new_callback(t, func(a, b unsafe.Pointer) int32 {
+		x, y := *(*int32)(a), *(*int32)(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}, t_int32, t_ptr, t_ptr)
+	defer cmp.Close()
+
+	qsort := new_func(t, libc, "qsort", nil, t_ptr, t_uint64, t_uint64, t_ptr)
+	xs := []int32{5, -3, 42, 0, 7, -100, 3, 3}
+	if _, err := qsort.Call(unsafe.Pointer(&xs[0]), len(xs), 4, cmp.UnsafeAddress()); err != nil {
+		t.Fatal(err)
+	}
+	if !sort.SliceIsSorted(xs, func(i, j int) bool { return xs[i] < xs[j] }) {
+		t.Errorf("qsort: got %v", xs)
+	}
+}
+
+func TestCallbackErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fn   interface{}
+		ret  Type
+		args []Type
+	}{
+		{"not a func", 42, t_int32, nil},
+		{"nil func", (func() int32)(nil), t_int32, nil},
+		{"parameters", func(x int64) int32 { return 0 }, t_int32, []Type{t_int32}},
+		{"result", func(x int32) int64 { return 0 }, t_int32, []Type{t_int32}},
+		{"void", func() int32 { return 0 }, nil, nil},
+		{"string", func() string { return "" }, t_string, nil},
+		{"pointer", func() *int32 { return nil }, TypeOf((*int32)(nil)), nil},
+		{"slice in a struct", func() test_slices { return test_slices{} },
+			TypeOf(test_slices{}), nil},
+		{"foreign ABI", func(x int32) {}, nil, []Type{ILP32.TypeOf(int32(0))}},
+	} {
+		if cb, err := NewCallback(test.fn, test.ret, test.args...); err == nil {
+			t.Errorf("%s: no error", test.name)
+			cb.Close()
+		}
+	}
+}
+
+func TestCallbackClose(t *testing.T) {
+	skip_calls(t)
+
+	fn := func() {}
+	cb := new_callback(t, fn, nil)
+	for i := 0; i < 2; i++ {
+		if err := cb.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+	if cb.UnsafeAddress() != nil {
+		t.Errorf("closed callback still has an address")
+	}
+
+	// the slots are exhausted, and released by Close
+	var cbs []*Callback
+	for {
+		cb, err := NewCallback(fn, nil)
+		if err != nil {
+			break
+		}
+		cbs = append(cbs, cb)
+		if len(cbs) > 64 {
+			t.Fatalf("more than 64 callbacks")
+		}
+	}
+	for _, cb := range cbs {
+		cb.Close()
+	}
+	new_callback(t, fn, nil).Close()
+}
+
+// EOF
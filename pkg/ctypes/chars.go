@@ -0,0 +1,174 @@
+package ctypes
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// An Overflow is the policy applied when encoding a string which does not
+// fit into a fixed-size char array
+type Overflow int
+
+const (
+	Truncate Overflow = iota // the string is truncated
+	Reject                   // a *StringOverflowError is returned
+)
+
+// A StringOverflowError is returned (or raised by the panicking variants
+// of the API) when a string does not fit into its fixed-size char array.
+type StringOverflowError struct {
+	Path string // the path to the offending field, e.g. "Event.name"
+	Len  int    // the length of the string
+	Cap  int    // the size of the char array
+}
+
+func (e *StringOverflowError) Error() string {
+	msg := fmt.Sprintf("ctypes: string of %d bytes overflows char[%d]", e.Len, e.Cap)
+	if e.Path == "" {
+		return msg
+	}
+	return msg + " for field " + e.Path
+}
+
+func (e *StringOverflowError) in_field(name string) {
+	e.Path = join_path(name, e.Path)
+}
+
+func (e *StringOverflowError) path() string {
+	return e.Path
+}
+
+// a Go string laid out as an inline, NUL-padded, char[n]
+type cchars_type struct {
+	common_type
+	n        int      // the size of the array, including the NUL terminator
+	overflow Overflow // the policy for the strings longer than n-1 bytes
+	elem     Type     // the C type of a char
+}
+
+// CharArray returns the C type char[n], for the Host ABI, which Go strings
+// are encoded into inline and NUL-padded, instead of as a char*.
+// The string must leave room for the NUL terminator: longer strings are
+// handled following the overflow policy.
+// Decoding reads the array up to its first NUL.
+// A struct field is mapped the same way with a `ctypes:"type=char[n]"` tag,
+// and an optional `ctypes:"overflow=truncate"` or `ctypes:"overflow=reject"`.
+func CharArray(n int, overflow Overflow) Type {
+	return Host.CharArray(n, overflow)
+}
+
+// CharArray returns the C type char[n] for this ABI (see CharArray.)
+func (abi *ABI) CharArray(n int, overflow Overflow) Type {
+	if n <= 0 {
+		panic(fmt.Sprintf("ctypes: invalid char array size [%d]", n))
+	}
+	return &cchars_type{
+		common_type: common_type{g_string, abi},
+		n:           n,
+		overflow:    overflow,
+		elem:        abi.gotype_to_ctype(g_char),
+	}
+}
+
+var (
+	g_string = reflect.TypeOf("")
+	g_char   = reflect.TypeOf(int8(0))
+)
+
+func (t *cchars_type) Name() string {
+	return ""
+}
+
+func (t *cchars_type) String() string {
+	return "char[" + strconv.Itoa(t.n) + "]"
+}
+
+func (t *cchars_type) Kind() Kind {
+	return Array
+}
+
+func (t *cchars_type) Elem() Type {
+	return t.elem
+}
+
+func (t *cchars_type) Len() int {
+	return t.n
+}
+
+func (t *cchars_type) Size() uintptr {
+	return uintptr(t.n)
+}
+
+func (t *cchars_type) Align() int {
+	return 1
+}
+
+func (t *cchars_type) FieldAlign() int {
+	return 1
+}
+
+// new_chars returns the char array named by the ctypes tag of the string
+// field f, nil if the tag does not name one.
+// the lock of abi.types_root() must be held.
+func (abi *ABI) new_chars(f reflect.StructField, opts tag_opts) *cchars_type {
+	name := opts["type"]
+	if !strings.HasPrefix(name, "char[") || !strings.HasSuffix(name, "]") {
+		if opts.has("overflow") {
+			tag_error(f.Tag, "overflow policy without a char array")
+		}
+		return nil
+	}
+	if f.Type.Kind() != reflect.String {
+		tag_error(f.Tag, "C type [%s] for non-string type [%v]", name, f.Type)
+	}
+	n, err := strconv.Atoi(name[len("char[") : len(name)-1])
+	if err != nil || n <= 0 {
+		tag_error(f.Tag, "invalid char array [%s]", name)
+	}
+	overflow := Truncate
+	switch opts["overflow"] {
+	case "", "truncate":
+	case "reject":
+		overflow = Reject
+	default:
+		tag_error(f.Tag, "unknown overflow policy [%s]", opts["overflow"])
+	}
+	return &cchars_type{
+		common_type: common_type{g_string, abi},
+		n:           n,
+		overflow:    overflow,
+		elem:        abi.new_ctype(g_char),
+	}
+}
+
+// encode_chars encodes the Go string rv into the char array ct at the cursor
+func encode_chars(v *Value, rv reflect.Value, ct *cchars_type) {
+	s := rv.String()
+	if len(s) >= ct.n {
+		if ct.overflow == Reject {
+			panic(&StringOverflowError{Len: len(s), Cap: ct.n})
+		}
+		s = s[:ct.n-1]
+	}
+	b := v.b[v.idx : v.idx+ct.n]
+	n := copy(b, s)
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
+	v.idx += ct.n
+}
+
+// decode_chars decodes the char array ct at the cursor into the Go string rv
+func decode_chars(v *Value, rv reflect.Value, ct *cchars_type) {
+	b := v.b[v.idx : v.idx+ct.n]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	writable(rv).SetString(string(b))
+	v.idx += ct.n
+}
+
+// EOF
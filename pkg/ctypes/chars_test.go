@@ -0,0 +1,64 @@
+package ctypes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+type ref_named struct {
+	Name string `ctypes:"type=char[8]"`
+	ID   int32
+	Tag  string `ctypes:"type=char[3],overflow=reject"`
+	X    float64
+}
+
+func TestCharArray(t *testing.T) {
+	check_layout(t, Host, "named", ref_named{}, cref.Named)
+
+	for _, test := range []struct {
+		in, out string
+		enc     string // the bytes of the char array
+	}{
+		{"", "", ""},
+		{"hello", "hello", "hello"},
+		{"1234567", "1234567", "1234567"},
+		{"12345678", "1234567", "1234567"}, // truncated, for the NUL
+		{"12\x0034", "12", "12\x0034"},
+	} {
+		in := ref_named{Name: test.in, ID: 1, Tag: "ab", X: 2}
+		v := ValueOf(&in)
+		encode(t, v, &in)
+		want := make([]byte, 8)
+		copy(want, test.enc)
+		if name := v.Buffer()[:8]; !bytes.Equal(name, want) {
+			t.Errorf("%q: encoded % x, want % x", test.in, name, want)
+		}
+		var out ref_named
+		decode(t, v, &out)
+		if want := (ref_named{Name: test.out, ID: 1, Tag: "ab", X: 2}); out != want {
+			t.Errorf("%q: decoded %+v, want %+v", test.in, out, want)
+		}
+	}
+
+	in := ref_named{Tag: "abc"}
+	_, err := NewEncoder(ValueOf(&in)).Encode(&in)
+	if e, ok := err.(*StringOverflowError); !ok || e.Path != "ref_named.Tag" || e.Len != 3 || e.Cap != 3 {
+		t.Errorf("got %v, want a *StringOverflowError for ref_named.Tag", err)
+	}
+
+	// a char array on its own
+	ct := CharArray(4, Truncate)
+	if ct.Size() != 4 || ct.Align() != 1 || ct.Len() != 4 {
+		t.Errorf("%v: size %d, align %d, len %d", ct, ct.Size(), ct.Align(), ct.Len())
+	}
+	v := New(ct)
+	s := "abcdef"
+	encode(t, v, &s)
+	if !bytes.Equal(v.Buffer(), []byte("abc\x00")) {
+		t.Errorf("%v: encoded %q", ct, v.Buffer())
+	}
+}
+
+// EOF
@@ -0,0 +1,264 @@
+package ctypes
+
+/*
+ #include <stdlib.h>
+*/
+import "C"
+
+import (
+	"reflect"
+	"runtime"
+	"unsafe"
+)
+
+// NewC returns a zeroed Value of type t whose buffer is allocated on the C heap.
+// Encoding into such a Value deep-copies slices and pointed-to values into C
+// memory owned by the Value, so it only ever holds C pointers and can be
+// handed to C functions under the cgo pointer-passing rules.
+// The C memory is released by Close, or else by the finalizer of the Value.
+func NewC(t Type) *Value {
+	if t == nil {
+		panic("ctypes: NewC(nil)")
+	}
+	sz := t.Size()
+	if sz == 0 {
+		sz = 1
+	}
+	p := C.calloc(1, C.size_t(sz))
+	if p == nil {
+		panic("ctypes: out of C memory")
+	}
+	v := &Value{
+		b:        c_bytes(p, t.Size()),
+		t:        t,
+		abi:      t.ABI(),
+		idx:      0,
+		cbuf:     p,
+		cstrings: make(map[int]cstring),
+	}
+	runtime.SetFinalizer(v, (*Value).free)
+	return v
+}
+
+// ValueOfC is like ValueOf but allocates the Value on the C heap (see NewC.)
+func ValueOfC(v interface{}) *Value {
+	return Host.ValueOfC(v)
+}
+
+// ValueOfC is like ValueOf but allocates the Value on the C heap (see NewC.)
+func (abi *ABI) ValueOfC(v interface{}) *Value {
+	rv := follow_ptr(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		panic(&UnsupportedTypeError{})
+	}
+	ct, err := abi.ctype_of(rv.Type())
+	if err != nil {
+		panic(err)
+	}
+	return NewC(ct)
+}
+
+// ValueAt returns a Value viewing the C memory at p as a value of type t,
+// e.g. a struct returned by a C library or a mmapped region.
+// The memory is not copied: it must stay valid while the Value is in use,
+// and it is not released with the Value. Pointers and C-strings are
+// followed when decoding, as for a Value created by NewC.
+// The C-strings and deep-copied values encoded into the Value are
+// allocated with malloc(3) and belong to the owner of the memory at p,
+// as the memory itself: they are not released by Close nor by the
+// finalizer of the Value, and have to be released with free(3).
+func ValueAt(t Type, p unsafe.Pointer) *Value {
+	if t == nil {
+		panic("ctypes: ValueAt(nil)")
+	}
+	if p == nil {
+		panic("ctypes: ValueAt with a NULL pointer")
+	}
+	v := &Value{
+		b:        c_bytes(p, t.Size()),
+		t:        t,
+		abi:      t.ABI(),
+		idx:      0,
+		cbuf:     p,
+		foreign:  true,
+		cstrings: make(map[int]cstring),
+	}
+	runtime.SetFinalizer(v, (*Value).free)
+	return v
+}
+
+// free releases all the C memory owned by v, including its buffer
+func (v *Value) free() {
+	// do not Reset: the memory of a foreign Value must be left untouched
+	v.release()
+	if v.cbuf != nil && !v.foreign {
+		C.free(v.cbuf)
+		v.cbuf = nil
+		v.b = nil
+	}
+}
+
+// SetDeepCopy sets whether encoding v deep-copies the pointed-to values
+// and the elements of slices into C memory owned by v, instead of storing
+// the addresses of the Go data. Pointed-to values are laid out as C values
+// of their own type, recursively, and nil pointers are stored as NULL;
+// decoding rebuilds the Go values from that C memory.
+// Values created by NewC and ValueAt always deep-copy.
+func (v *Value) SetDeepCopy(on bool) {
+	v.deepcp = on
+}
+
+// deep returns whether pointers and slices are deep-copied into C memory
+func (v *Value) deep() bool {
+	return v.cbuf != nil || v.deepcp
+}
+
+// c_alloc allocates n zeroed bytes of C memory, owned by v (or its arena,
+// or the owner of its foreign memory)
+func (v *Value) c_alloc(n uintptr) unsafe.Pointer {
+	if v.arena != nil {
+		return v.arena.alloc(n)
+	}
+	if n == 0 {
+		n = 1
+	}
+	p := C.calloc(1, C.size_t(n))
+	if p == nil {
+		panic("ctypes: out of C memory")
+	}
+	if !v.foreign {
+		v.cmems = append(v.cmems, p)
+	}
+	return p
+}
+
+// c_string returns a copy of s as a C-string, owned by the caller
+// (or the arena of v)
+func (v *Value) c_string(s string) cstring {
+	if v.arena == nil {
+		return C.CString(s)
+	}
+	p := v.arena.alloc(uintptr(len(s) + 1))
+	copy(c_bytes(p, uintptr(len(s))), s)
+	return cstring(p)
+}
+
+// c_bytes returns a []byte view over the n bytes of memory at p
+func c_bytes(p unsafe.Pointer, n uintptr) []byte {
+	var b []byte
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	h.Data = uintptr(p)
+	h.Len = int(n)
+	h.Cap = int(n)
+	return b
+}
+
+// in_block runs fn with the cursor moved to the start of the n bytes
+// of memory at p, instead of the buffer of v
+func (v *Value) in_block(p unsafe.Pointer, n uintptr, fn func()) {
+	b, idx := v.b, v.idx
+	v.b, v.idx = c_bytes(p, n), 0
+	v.nested++
+	defer func() {
+		v.b, v.idx = b, idx
+		v.nested--
+	}()
+	fn()
+}
+
+// ptr_key identifies a pointed-to value. The type is part of the key,
+// as a struct and its first field share the same address.
+type ptr_key struct {
+	addr uintptr
+	t    reflect.Type
+}
+
+// track_pointers starts tracking the pointed-to values met while encoding
+// or decoding rv, the root of the values held by v, so that values shared
+// by several pointers are only copied once and cycles terminate.
+func (v *Value) track_pointers(rv reflect.Value) {
+	v.encoded = make(map[ptr_key]unsafe.Pointer)
+	v.decoded = make(map[ptr_key]unsafe.Pointer)
+	root := v.UnsafeAddress()
+	if v.deep() && root != nil && rv.CanAddr() {
+		// pointers back to the root refer to the buffer itself,
+		// be it C memory or the Go buffer of a deep-copying Value
+		v.encoded[ptr_key{rv.UnsafeAddr(), rv.Type()}] = root
+		v.decoded[ptr_key{uintptr(root), rv.Type()}] = unsafe.Pointer(rv.UnsafeAddr())
+	}
+}
+
+// untrack_pointers forgets the values tracked since track_pointers
+func (v *Value) untrack_pointers() {
+	v.encoded = nil
+	v.decoded = nil
+}
+
+// encode_pointee returns the address of a new block of C memory owned by v
+// holding the encoded pointed-to Go value rv. A Go value already encoded
+// gives the same block.
+func (v *Value) encode_pointee(rv reflect.Value) unsafe.Pointer {
+	key := ptr_key{rv.UnsafeAddr(), rv.Type()}
+	if p, ok := v.encoded[key]; ok {
+		return p
+	}
+	ct := v.abi.gotype_to_ctype(rv.Type())
+	p := v.c_alloc(ct.Size())
+	if v.encoded != nil {
+		// registered before encoding, for the cycles back to rv
+		v.encoded[key] = p
+	}
+	v.in_block(p, ct.Size(), func() {
+		encode_value(v, rv)
+	})
+	return p
+}
+
+// encode_slice_block encodes the elements of the Go slice rv into
+// a new block of C memory owned by v and returns its address
+func (v *Value) encode_slice_block(rv reflect.Value) unsafe.Pointer {
+	et := v.abi.gotype_to_ctype(rv.Type().Elem())
+	n := rv.Len()
+	sz := uintptr(n) * et.Size()
+	p := v.c_alloc(sz)
+	v.in_block(p, sz, func() {
+		for i := 0; i < n; i++ {
+			encode_value(v, rv.Index(i))
+		}
+	})
+	return p
+}
+
+// decode_pointee returns the address of a new Go value of type t decoded
+// from the C value at p. A C value already decoded gives the same Go value.
+func (v *Value) decode_pointee(p unsafe.Pointer, t reflect.Type) unsafe.Pointer {
+	key := ptr_key{uintptr(p), t}
+	if ptr, ok := v.decoded[key]; ok {
+		return ptr
+	}
+	ct := v.abi.gotype_to_ctype(t)
+	rv := reflect.New(t)
+	ptr := unsafe.Pointer(rv.Pointer())
+	if v.decoded != nil {
+		// registered before decoding, for the cycles back to rv
+		v.decoded[key] = ptr
+	}
+	v.in_block(p, ct.Size(), func() {
+		decode_value(v, rv.Elem())
+	})
+	return ptr
+}
+
+// decode_slice_block decodes the elements of the Go slice rv from
+// the C array at p
+func (v *Value) decode_slice_block(p unsafe.Pointer, rv reflect.Value) {
+	et := v.abi.gotype_to_ctype(rv.Type().Elem())
+	n := rv.Len()
+	v.in_block(p, uintptr(n)*et.Size(), func() {
+		for i := 0; i < n; i++ {
+			decode_value(v, rv.Index(i))
+		}
+	})
+}
+
+// EOF
@@ -0,0 +1,229 @@
+package ctypes
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+type (
+	test_cval struct {
+		Name string
+		Xs   []int32
+		P    *test_cval_in
+	}
+	test_cval_in struct {
+		F float64
+		S string
+	}
+)
+
+// c_string_at returns the Go copy of the C-string at p
+func c_string_at(p unsafe.Pointer) string {
+	var b []byte
+	for ; *(*byte)(p) != 0; p = unsafe.Pointer(uintptr(p) + 1) {
+		b = append(b, *(*byte)(p))
+	}
+	return string(b)
+}
+
+// field_offset returns the offset of the field name of the C struct ct
+func field_offset(ct Type, name string) uintptr {
+	for i := 0; i < ct.NumField(); i++ {
+		if f := ct.Field(i); f.Name == name {
+			return f.Offset
+		}
+	}
+	panic("no field " + name)
+}
+
+func TestNewC(t *testing.T) {
+	in := test_cval{"hello", []int32{1, 2, 3}, &test_cval_in{1.5, "world"}}
+	ct := TypeOf(in)
+	v := NewC(ct)
+	addr := v.UnsafeAddress()
+	if addr == nil || addr != unsafe.Pointer(&v.Buffer()[0]) {
+		t.Fatalf("NewC: address %v, buffer at %p", addr, &v.Buffer()[0])
+	}
+	encode(t, v, &in)
+
+	// the char* points to a C copy of the string
+	name := *(*unsafe.Pointer)(unsafe.Pointer(uintptr(addr) + field_offset(ct, "Name")))
+	if got := c_string_at(name); got != in.Name {
+		t.Errorf("NewC: char* to %q, want %q", got, in.Name)
+	}
+	var out test_cval
+	decode(t, v, &out)
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("NewC: decoded %+v, want %+v", out, in)
+	}
+	if out.P == in.P || &out.Xs[0] == &in.Xs[0] {
+		t.Errorf("NewC: decoded values alias the encoded ones")
+	}
+
+	// the C memory of a zero-size value still has an address
+	if NewC(TypeOf(struct{}{})).UnsafeAddress() == nil {
+		t.Errorf("NewC: no address for a zero-size type")
+	}
+	if ValueOf(&struct{}{}).UnsafeAddress() != nil {
+		t.Errorf("ValueOf: an address for a zero-size type")
+	}
+}
+
+// the pointers of another ABI than Host can not be followed
+func TestNewCForeignABI(t *testing.T) {
+	for _, abi := range []*ABI{ILP32, I386, LP64BE} {
+		in := test_cval{"hello", []int32{1, 2}, &test_cval_in{F: 2}}
+		v := abi.ValueOfC(&in)
+		encode(t, v, &in)
+		var out test_cval
+		decode(t, v, &out)
+		if out.Name != in.Name || out.Xs != nil || out.P != nil {
+			t.Errorf("%s: decoded %+v, want nil pointers and slices", abi, out)
+		}
+	}
+}
+
+func TestValueOfCError(t *testing.T) {
+	defer func() {
+		const msg = "ctypes: unsupported type [map[string]int] for field test_bad.In.M"
+		if r, ok := recover().(error); !ok || r.Error() != msg {
+			t.Errorf("ValueOfC: panicked with %v, want %q", r, msg)
+		}
+	}()
+	ValueOfC(&test_bad{})
+}
+
+func TestValueAt(t *testing.T) {
+	ct := TypeOf(test_cval{})
+	mem := NewC(ct)
+	v := ValueAt(ct, mem.UnsafeAddress())
+	if v.UnsafeAddress() != mem.UnsafeAddress() {
+		t.Fatalf("ValueAt: address %v, want %v", v.UnsafeAddress(), mem.UnsafeAddress())
+	}
+
+	// the memory is shared, not copied
+	in := test_cval{"hello", []int32{1, 2, 3}, &test_cval_in{1.5, "world"}}
+	encode(t, v, &in)
+	var out test_cval
+	decode(t, mem, &out)
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("ValueAt: decoded %+v, want %+v", out, in)
+	}
+
+	// the payloads encoded through v belong to the owner of the memory:
+	// they outlive v
+	v = nil
+	runtime.GC()
+	runtime.GC()
+	out = test_cval{}
+	decode(t, mem, &out)
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("ValueAt: decoded %+v once collected, want %+v", out, in)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("ValueAt: no panic for a NULL pointer")
+		}
+	}()
+	ValueAt(ct, nil)
+}
+
+func TestDeepCopy(t *testing.T) {
+	in := test_cval{"hello", []int32{1, 2, 3}, &test_cval_in{1.5, "world"}}
+	ct := TypeOf(in)
+	v := ValueOf(&in)
+	v.SetDeepCopy(true)
+	encode(t, v, &in)
+	pointer := func() unsafe.Pointer {
+		return *(*unsafe.Pointer)(unsafe.Pointer(&v.Buffer()[field_offset(ct, "P")]))
+	}
+
+	// the pointer is the one of a C block holding the pointed-to value
+	p := pointer()
+	if p == nil || p == unsafe.Pointer(in.P) {
+		t.Fatalf("deep copy: pointer %v, Go value at %p", p, in.P)
+	}
+	if f := *(*float64)(p); f != in.P.F {
+		t.Errorf("deep copy: pointed-to value holds %v, want %v", f, in.P.F)
+	}
+	var out test_cval
+	decode(t, v, &out)
+	if !reflect.DeepEqual(out, in) || out.P == in.P {
+		t.Errorf("deep copy: decoded %+v, want a copy of %+v", out, in)
+	}
+
+	// nil pointers are NULL
+	in.P = nil
+	encode(t, v, &in)
+	if p := pointer(); p != nil {
+		t.Errorf("deep copy: nil pointer encoded as %v", p)
+	}
+	decode(t, v, &out)
+	if out.P != nil {
+		t.Errorf("deep copy: NULL decoded as %v", out.P)
+	}
+}
+
+type (
+	test_node struct {
+		X    int64
+		Next *test_node
+	}
+	test_shared struct {
+		A, B *test_cval_in
+	}
+)
+
+func TestDeepCopyShared(t *testing.T) {
+	p := &test_cval_in{F: 2}
+	in := test_shared{p, p}
+	for _, v := range []*Value{ValueOfC(&in), ValueOf(&in)} {
+		v.SetDeepCopy(true)
+		encode(t, v, &in)
+		words := (*[2]unsafe.Pointer)(unsafe.Pointer(&v.Buffer()[0]))
+		if words[0] != words[1] {
+			t.Errorf("shared pointer copied twice: %v, %v", words[0], words[1])
+		}
+		var out test_shared
+		decode(t, v, &out)
+		if out.A != out.B || *out.A != *p {
+			t.Errorf("shared pointer decoded as %p (%+v), %p", out.A, out.A, out.B)
+		}
+	}
+}
+
+func TestDeepCopyCycles(t *testing.T) {
+	a := test_node{X: 1}
+	b := test_node{X: 2, Next: &a}
+	a.Next = &b
+	self := test_node{X: 3}
+	self.Next = &self
+	for _, in := range []*test_node{&a, &self} {
+		for _, v := range []*Value{ValueOfC(in), ValueOf(in)} {
+			v.SetDeepCopy(true)
+			encode(t, v, in)
+			var z test_node
+			decode(t, v, &z)
+			// walk both cycles: the decoded one closes on z
+			p, q := in, &z
+			for {
+				if q == nil || q.X != p.X {
+					t.Errorf("cycle of %d decoded as %+v", in.X, q)
+					break
+				}
+				p, q = p.Next, q.Next
+				if p == in {
+					if q != &z {
+						t.Errorf("cycle of %d not closed on the root: %p, %p", in.X, q, &z)
+					}
+					break
+				}
+			}
+		}
+	}
+}
+
+// EOF
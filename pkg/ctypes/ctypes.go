@@ -7,7 +7,10 @@ package ctypes
 import "C"
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"runtime"
 	"unsafe"
@@ -29,6 +32,14 @@ type Type interface {
 	// a value of the given type; it is analogous to unsafe.Sizeof.
 	Size() uintptr
 
+	// Align returns the alignment in bytes of a value of
+	// this type when allocated in memory, following the C ABI.
+	Align() int
+
+	// FieldAlign returns the alignment in bytes of a value of
+	// this type when used as a field in a C struct.
+	FieldAlign() int
+
 	// String returns a string representation of the type.
 	// The string representation may use shortened package names
 	// (e.g., vector instead of "container/vector") and is not
@@ -58,6 +69,9 @@ type Type interface {
 
 	// GoType returns the original reflect.Type which is being shadowed
 	GoType() reflect.Type
+
+	// ABI returns the target ABI this type has been laid out for.
+	ABI() *ABI
 }
 
 // A Kind represents the specific kind of type that a Type represents.
@@ -65,6 +79,9 @@ type Type interface {
 type Kind reflect.Kind
 
 func (k Kind) String() string {
+	if k == Union {
+		return "union"
+	}
 	return reflect.Kind(k).String()
 }
 
@@ -87,7 +104,7 @@ const (
 	Complex64       = Kind(reflect.Complex64)
 	Complex128      = Kind(reflect.Complex128)
 	Array           = Kind(reflect.Array)
-	//Chan        
+	//Chan
 	//Func
 	//Interface
 	//Map // <-- FIXME? can we implement this ?
@@ -96,6 +113,9 @@ const (
 	String        = Kind(reflect.String)
 	Struct        = Kind(reflect.Struct)
 	UnsafePointer = Kind(reflect.UnsafePointer)
+
+	// kinds without a Go counterpart
+	Union = Kind(reflect.UnsafePointer + 1)
 )
 
 type StructField struct {
@@ -106,6 +126,130 @@ type StructField struct {
 	Offset    uintptr
 	Index     []int
 	Anonymous bool
+
+	// BitOffset and BitSize locate a bit-field within its storage unit,
+	// which starts at Offset and has the size of Type. BitOffset counts
+	// from the first bit allocated in the unit: the least significant one
+	// on little-endian targets, the most significant one on big-endian ones.
+	// BitSize is 0 for fields which are not bit-fields.
+	BitOffset uintptr
+	BitSize   uintptr
+}
+
+// An UnsupportedTypeError is returned (or raised by the panicking
+// variants of the API) when a Go type has no C representation.
+type UnsupportedTypeError struct {
+	Type reflect.Type // the offending Go type
+	Path string       // the path to the offending field, e.g. "Event.t.s0"
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	name := "nil"
+	if e.Type != nil {
+		name = e.Type.String()
+	}
+	if e.Path == "" {
+		return "ctypes: unsupported type [" + name + "]"
+	}
+	return "ctypes: unsupported type [" + name + "] for field " + e.Path
+}
+
+// in_field prepends the name of the enclosing field to the error path
+func (e *UnsupportedTypeError) in_field(name string) {
+	e.Path = join_path(name, e.Path)
+}
+
+func (e *UnsupportedTypeError) path() string {
+	return e.Path
+}
+
+// A StructTagError is returned (or raised by the panicking variants
+// of the API) when the ctypes tag of a struct field is invalid.
+type StructTagError struct {
+	Tag  string // the offending tag
+	Path string // the path to the offending field, e.g. "Event.u"
+	Msg  string // what is wrong with the tag
+}
+
+func (e *StructTagError) Error() string {
+	return "ctypes: invalid tag `" + e.Tag + "` for field " + e.Path + ": " + e.Msg
+}
+
+func (e *StructTagError) in_field(name string) {
+	e.Path = join_path(name, e.Path)
+}
+
+func (e *StructTagError) path() string {
+	return e.Path
+}
+
+// A LengthError is returned (or raised by the panicking variants of the
+// API) when the vl-arrays sharing a length field have different lengths.
+type LengthError struct {
+	Path  string // the path to the length field, e.g. "Event.n"
+	Len   int    // the length of the first vl-array
+	Other int    // the length of another vl-array
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("ctypes: vl-arrays sharing the length field %s have different lengths (%d != %d)",
+		e.Path, e.Len, e.Other)
+}
+
+func (e *LengthError) in_field(name string) {
+	e.Path = join_path(name, e.Path)
+}
+
+func (e *LengthError) path() string {
+	return e.Path
+}
+
+// a path_error is an error raised while walking a Go type,
+// which records the path to the offending field
+type path_error interface {
+	error
+	in_field(name string)
+	path() string
+}
+
+// join_path prepends the name of a field to a path of fields
+func join_path(name, path string) string {
+	if path == "" {
+		return name
+	}
+	return name + "." + path
+}
+
+// field_error is deferred while walking the fields of a struct:
+// it records the current field into the path of a path_error
+// being raised and raises it again.
+func field_error(name *string) {
+	if r := recover(); r != nil {
+		if e, ok := r.(path_error); ok {
+			e.in_field(*name)
+		}
+		panic(r)
+	}
+}
+
+// catch_error is deferred by the entry points of the package:
+// it turns a path_error raised while walking the Go type t
+// into an error.
+func catch_error(t reflect.Type, err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(path_error)
+		if !ok {
+			panic(r)
+		}
+		if e.path() != "" && t != nil {
+			name := t.Name()
+			if name == "" {
+				name = t.String()
+			}
+			e.in_field(name)
+		}
+		*err = e
+	}
 }
 
 type cstring *C.char
@@ -113,9 +257,30 @@ type cstring *C.char
 type Value struct {
 	b   []byte // the C value for that Value
 	t   Type   // the C type of that Value
+	abi *ABI   // the target ABI of that Value
 	idx int    // the cursor index in the byte buffer of the C-value
 
 	cstrings map[int]cstring // a pool of C-string we own. index is the offset in the Value.b buffer
+
+	cbuf    unsafe.Pointer   // the C memory backing b, nil if b is Go-allocated
+	foreign bool             // whether cbuf is owned by someone else (see ValueAt)
+	deepcp  bool             // whether pointers and slices are deep-copied (see SetDeepCopy)
+	cmems   []unsafe.Pointer // C memory blocks we own (deep-copied slices, pointees and their strings)
+	nested  int              // depth of the C block the cursor is in, 0 for b itself
+	strmax  int              // the maximum length of a decoded C-string, 0 for no limit
+	order   binary.ByteOrder // the byte order of the field at the cursor, nil for that of the ABI
+	closed  bool             // whether Close was called
+	arena   *Arena           // the arena allocating the C memory of the Value, nil if none
+	agen    int              // the generation of the arena the Value was allocated in
+
+	encoded map[ptr_key]unsafe.Pointer // C blocks of the Go values already encoded
+	decoded map[ptr_key]unsafe.Pointer // Go values of the C values already decoded
+}
+
+// writable returns the addressable value rv, even if it was obtained
+// through unexported struct fields
+func writable(rv reflect.Value) reflect.Value {
+	return reflect.NewAt(rv.Type(), unsafe.Pointer(rv.UnsafeAddr())).Elem()
 }
 
 func follow_ptr(v reflect.Value) reflect.Value {
@@ -128,17 +293,18 @@ func follow_ptr(v reflect.Value) reflect.Value {
 			return rv
 		}
 	}
-	return rv
 }
 
-// ValueOf returns the ctypes.Value corresponding to the Go-value v
+// ValueOf returns the ctypes.Value corresponding to the Go-value v,
+// laid out for the Host ABI.
+// It panics with an *UnsupportedTypeError if v has no C representation.
 func ValueOf(v interface{}) *Value {
-	rv := reflect.ValueOf(v)
-	//fmt.Printf("valueof--> %v\n",rv)
-	rv = follow_ptr(rv)
-	//fmt.Printf("valueof==> %v\n",rv)
-	ct := gotype_to_ctype(rv.Type())
-	return New(ct)
+	return Host.ValueOf(v)
+}
+
+// ValueOfErr is like ValueOf but returns an error instead of panicking.
+func ValueOfErr(v interface{}) (*Value, error) {
+	return Host.ValueOfErr(v)
 }
 
 func New(t Type) *Value {
@@ -148,26 +314,70 @@ func New(t Type) *Value {
 	v := &Value{
 		b:        make([]byte, t.Size()),
 		t:        t,
+		abi:      t.ABI(),
 		idx:      0,
 		cstrings: make(map[int]cstring),
 	}
-	runtime.SetFinalizer(v, (*Value).Reset)
+	runtime.SetFinalizer(v, (*Value).free)
 	return v
 }
 
+// ErrClosed is returned when encoding or decoding a closed Value
+var ErrClosed = errors.New("ctypes: use of closed Value")
+
+// Close releases all the C memory owned by v right away, instead of
+// waiting for its finalizer: its C-strings, its deep-copied values and
+// its buffer if it was allocated by NewC. The memory viewed by a Value
+// created by ValueAt is left untouched, as well as the C-strings and
+// values encoded into it.
+// v can not be encoded nor decoded anymore: ErrClosed is returned.
+// Closing a Value more than once is a no-op.
+func (v *Value) Close() error {
+	if v.is_closed() {
+		return nil
+	}
+	runtime.SetFinalizer(v, nil)
+	v.free()
+	v.b = nil
+	v.closed = true
+	return nil
+}
+
 func (v *Value) Reset() {
 	v.idx = 0
+	v.release()
+
+	for i := range v.b {
+		v.b[i] = byte(0)
+	}
+}
+
+// release frees the C-strings and C memory blocks owned by v
+func (v *Value) release() {
 	for i := range v.cstrings {
 		C.free(unsafe.Pointer(v.cstrings[i]))
 	}
 	v.cstrings = make(map[int]cstring)
-
-	for i := range v.b {
-		v.b[i] = byte(0)
+	for _, p := range v.cmems {
+		C.free(p)
 	}
+	v.cmems = nil
+}
+
+// SetMaxStringLen sets the maximum number of bytes read from a C-string
+// when decoding, so that strings which are not NUL-terminated (or not
+// in time) are truncated instead of overrunning the C memory.
+// n <= 0 means no limit, which is the default.
+func (v *Value) SetMaxStringLen(n int) {
+	v.strmax = n
 }
 
+// Buffer returns the bytes of the C value, nil once v is closed
+// (or its arena freed.)
 func (v *Value) Buffer() []byte {
+	if v.is_closed() {
+		return nil
+	}
 	return v.b
 }
 
@@ -175,7 +385,25 @@ func (v *Value) Type() Type {
 	return v.t
 }
 
+// is_closed returns whether v was closed, or its arena freed
+func (v *Value) is_closed() bool {
+	return v.closed || (v.arena != nil && v.arena.gen != v.agen)
+}
+
+// UnsafeAddress returns the address of the C value, nil once v is closed.
+// The C memory of a Value created by NewC, ValueAt or an Arena always has
+// an address, even for a zero-size type: a Go-allocated Value of a
+// zero-size type has none (nil.)
 func (v *Value) UnsafeAddress() unsafe.Pointer {
+	if v.is_closed() {
+		return nil
+	}
+	if v.cbuf != nil {
+		return v.cbuf
+	}
+	if len(v.b) == 0 {
+		return nil
+	}
 	// c_addr := (*uintptr)((*uintptr)(unsafe.Pointer(&v.b[0])))
 	// return uintptr(*c_addr)
 	return unsafe.Pointer(&v.b[0])
@@ -198,18 +426,49 @@ type doublecomplex struct {
 	imag float64
 }
 
-// get the C type corresponding to a Go value
+// get the C type corresponding to a Go value, for the Host ABI.
+// It panics with an *UnsupportedTypeError if v has no C representation.
 func TypeOf(v interface{}) Type {
-	rt := reflect.TypeOf(v)
-	return gotype_to_ctype(rt)
+	return Host.TypeOf(v)
+}
+
+// TypeOfErr is like TypeOf but returns an error instead of panicking.
+func TypeOfErr(v interface{}) (Type, error) {
+	return Host.TypeOfErr(v)
 }
 
-// map of already translated-to-Ctypes types
-var ctypeds map[reflect.Type]Type
+// get the C type corresponding to a Go type.
+// it is safe for concurrent use.
+func (abi *ABI) gotype_to_ctype(t reflect.Type) Type {
+	if t == nil {
+		panic(&UnsupportedTypeError{Type: t})
+	}
+	r := abi.types_root()
+	r.mu.RLock()
+	ctype, ok := r.ctypeds[type_key{t, abi.Pack}]
+	r.mu.RUnlock()
+	if ok {
+		// already processed...
+		return ctype
+	}
+
+	// types are built under the write lock, so that concurrent
+	// builders of the same type end up with the same instance.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return abi.new_ctype(t)
+}
 
-// get the C type corresponding to a Go type
-func gotype_to_ctype(t reflect.Type) Type {
-	ctype, ok := ctypeds[t]
+// new_ctype returns the C type corresponding to a Go type,
+// creating it if needed. the lock of abi.types_root() must be held.
+func (abi *ABI) new_ctype(t reflect.Type) Type {
+	r := abi.types_root()
+	if r.ctypeds == nil {
+		r.ctypeds = make(map[type_key]Type)
+	}
+	ctypeds := r.ctypeds
+	key := type_key{t, abi.Pack}
+	ctype, ok := ctypeds[key]
 	if ok {
 		// already processed...
 		return ctype
@@ -221,63 +480,70 @@ func gotype_to_ctype(t reflect.Type) Type {
 		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
 		reflect.Uintptr,
 		reflect.Float32, reflect.Float64:
-		ctype := &common_type{t}
-		ctypeds[t] = ctype
+		ctype := &common_type{t, abi}
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.Complex64:
-		ctype := new_cstruct(g_complex64)
-		ctypeds[t] = ctype
+		ctype := new_cstruct(abi, g_complex64)
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.Complex128:
-		ctype := new_cstruct(g_complex128)
-		ctypeds[t] = ctype
+		ctype := new_cstruct(abi, g_complex128)
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.Ptr:
-		ctype := &common_type{t}
-		ctypeds[t] = ctype
+		ctype := &common_type{t, abi}
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.Array:
-		ctype := &common_type{t}
-		ctypeds[t] = ctype
+		// the element type is resolved now, as the size and alignment
+		// of the array are needed while the types cache is locked.
+		ctype := &carray_type{common_type{t, abi}, abi.new_ctype(t.Elem())}
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.Slice:
-		ctype := &vlarray_type{common_type{t}}
-		ctypeds[t] = ctype
+		ctype := &vlarray_type{common_type{t, abi}}
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.String:
-		ctype := &cstring_type{common_type{t}}
-		ctypeds[t] = ctype
+		ctype := &cstring_type{common_type{t, abi}}
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.Struct:
-		ctype := new_cstruct(t)
-		ctypeds[t] = ctype
+		if is_union(t) {
+			ctype := new_cunion(abi, t)
+			ctypeds[key] = ctype
+			return ctype
+		}
+		ctype := new_cstruct(abi, t)
+		ctypeds[key] = ctype
 		return ctype
 
 	case reflect.UnsafePointer:
-		ctype := &common_type{t}
-		ctypeds[t] = ctype
+		ctype := &common_type{t, abi}
+		ctypeds[key] = ctype
 		return ctype
 
 	default:
-		panic("not handled type")
+		panic(&UnsupportedTypeError{Type: t})
 	}
-	return nil
 }
 
 type ctype struct {
 	gotype reflect.Type // the Go type this C-type shadows
 }
 
-// a type whose Go type exactly matches the C one
+// a type whose Go type matches the C one, modulo the ABI sizes
 type common_type struct {
 	reflect.Type
+	abi *ABI // the target ABI
 }
 
 func (t *common_type) Kind() Kind {
@@ -285,7 +551,7 @@ func (t *common_type) Kind() Kind {
 }
 
 func (t *common_type) Elem() Type {
-	return gotype_to_ctype(t.Type.Elem())
+	return t.abi.gotype_to_ctype(t.Type.Elem())
 }
 
 func (t *common_type) Field(i int) (c StructField) {
@@ -293,7 +559,7 @@ func (t *common_type) Field(i int) (c StructField) {
 	c = StructField{
 		PkgPath: f.PkgPath,
 		Name:    f.Name,
-		Type:    gotype_to_ctype(f.Type),
+		Type:    t.abi.gotype_to_ctype(f.Type),
 		Tag:     string(f.Tag),
 		// FIXME?: this should be corrected for vlarrays/cstrings
 		Offset: f.Offset,
@@ -308,122 +574,432 @@ func (t *common_type) GoType() reflect.Type {
 	return t.Type
 }
 
+func (t *common_type) ABI() *ABI {
+	return t.abi
+}
+
+func (t *common_type) Size() uintptr {
+	return t.abi.sizeof(t.Type)
+}
+
+func (t *common_type) Align() int {
+	return int(t.abi.alignof(t.Size()))
+}
+
+func (t *common_type) FieldAlign() int {
+	return int(t.abi.field_alignof(t.Size()))
+}
+
+type carray_type struct {
+	common_type
+	elem Type // the C type of the elements
+}
+
+func (t *carray_type) Elem() Type {
+	return t.elem
+}
+
+func (t *carray_type) Size() uintptr {
+	return uintptr(t.Len()) * t.Elem().Size()
+}
+
+func (t *carray_type) Align() int {
+	return t.Elem().Align()
+}
+
+func (t *carray_type) FieldAlign() int {
+	return t.Elem().FieldAlign()
+}
+
 type vlarray_type struct {
-	common_type "vlarray"
+	common_type
 }
 
+// a vl-array is laid out as a {int n; T* data;} pair
 func (t *vlarray_type) Size() uintptr {
-	sz := reflect.TypeOf(uintptr(0)).Size() + reflect.TypeOf(int(0)).Size()
+	sz := 2 * t.abi.PtrSize
 	return sz
 }
 
+func (t *vlarray_type) Align() int {
+	return int(t.abi.alignof(t.abi.PtrSize))
+}
+
+func (t *vlarray_type) FieldAlign() int {
+	return t.Align()
+}
+
 type cstring_type struct {
-	common_type "cstring"
+	common_type
 }
 
 func (t *cstring_type) Size() uintptr {
-	ptr_sz := reflect.TypeOf(uintptr(0)).Size()
+	ptr_sz := t.abi.PtrSize
 	//elem_sz := reflect.TypeOf(byte(0)).Size()
 	//nelems_sz := reflect.TypeOf(int(0)).Size()
 	return ptr_sz // + nelems_sz
 }
 
+// a C-string is a char*
+func (t *cstring_type) Align() int {
+	return int(t.abi.alignof(t.abi.PtrSize))
+}
+
+func (t *cstring_type) FieldAlign() int {
+	return t.Align()
+}
+
 type cstruct_type struct {
-	common_type "cstruct"
-	fields_map  map[string]int
-	fields_idx  []StructField
+	common_type
+	fields_map map[string]int
+	fields_idx []StructField
+	size       uintptr // size of the C struct, including tail padding
+	align      uintptr // alignment of the C struct
+
+	// the Go index of the discriminator of each union field driven by one
+	discr map[string]int
+
+	// the mapping of the fields with a ctypes tag, by Go name
+	mappings map[string]*field_mapping
+
+	// the length slot of each vl-array field, by Go name
+	lengths map[string]*vlen
+	// the Go index of the vl-arrays whose length is held by a field, by Go name
+	counted map[string][]int
+}
+
+// vlen is the slot holding the length of a vl-array field of a struct:
+// a hidden field, or a sibling field named by a `ctypes:"len=..."` tag
+type vlen struct {
+	field  int              // the index of the slot in the C struct
+	order  binary.ByteOrder // the byte order of the slot, nil for the one of the ABI
+	shared bool             // whether the slot is a sibling field
 }
 
-func new_cstruct(t reflect.Type) *cstruct_type {
+func new_cstruct(abi *ABI, t reflect.Type) *cstruct_type {
 	c := &cstruct_type{
-		common_type: common_type{t},
+		common_type: common_type{t, abi},
 		fields_map:  make(map[string]int),
 		fields_idx:  []StructField{},
+		discr:       make(map[string]int),
+		mappings:    make(map[string]*field_mapping),
+		lengths:     make(map[string]*vlen),
+		counted:     make(map[string][]int),
 	}
 
+	// fields are indexed by their Go name, and named after their C name
 	fields := make([]StructField, 0, 0)
 	fmap := make(map[string]int)
+	layouts := make([]field_layout, 0, 0)
+	siblings := make([][2]string, 0, 0) // the vl-arrays and their length field, resolved last
+
+	// register the struct before laying out its fields, so that
+	// references to itself resolve to this very instance.
+	// it is unregistered if one of its fields can not be converted.
+	abi.register(t, c)
+	done := false
+	defer func() {
+		if !done {
+			abi.unregister(t)
+		}
+	}()
+
+	name := ""
+	defer field_error(&name)
 
 	nfields := t.NumField()
 	for i := 0; i < nfields; i++ {
 		f := t.Field(i)
-		cf := gotype_to_ctype(f.Type)
+		name = f.Name
+		opts := parse_tag(f.Tag)
+		if opts.has("skip") || opts.has("-") {
+			continue
+		}
+		cname := f.Name
+		if n, ok := opts["name"]; ok {
+			cname = n
+		}
+		m := abi.new_mapping(f, opts)
+		if m != nil {
+			c.mappings[f.Name] = m
+		}
+		fabi := abi.field_abi(f, opts) // the ABI of the type of the field
+		var cf Type
+		switch {
+		case m != nil && m.ctype != nil:
+			cf = fabi.new_ctype(m.ctype)
+		case m != nil && m.chars != nil:
+			cf = m.chars
+		default:
+			cf = fabi.new_ctype(f.Type)
+		}
+		var nbr *StructField // the hidden slot for the length of a vl-array
+		after := false       // whether that slot follows the vl-array
 		if cf.Kind() == Slice {
-			// insert a slot for the size of the vl-array
-			csf := StructField{
-				PkgPath:   f.PkgPath,
-				Name:      f.Name + "_nbr",
-				Type:      gotype_to_ctype(reflect.TypeOf(int(0))),
-				Tag:       string(f.Tag) + " | size of " + f.Name,
-				Offset:    f.Offset,
-				Index:     f.Index,
-				Anonymous: f.Anonymous,
+			if d, ok := opts["len"]; ok {
+				if opts.has("lentype") || opts.has("lenpos") {
+					tag_error(f.Tag, "len excludes lentype and lenpos")
+				}
+				siblings = append(siblings, [2]string{f.Name, d})
+			} else {
+				// insert a slot for the size of the vl-array
+				lt := reflect.TypeOf(int(0))
+				if s, ok := opts["lentype"]; ok {
+					lt, ok = abi.c_scalar(s)
+					if !ok || !is_integer(lt) {
+						tag_error(f.Tag, "invalid length type [%s]", s)
+					}
+				}
+				switch opts["lenpos"] {
+				case "", "before":
+				case "after":
+					after = true
+				default:
+					tag_error(f.Tag, "invalid length position [%s]", opts["lenpos"])
+				}
+				nbr = &StructField{
+					PkgPath:   f.PkgPath,
+					Name:      cname + "_nbr",
+					Type:      abi.new_ctype(lt),
+					Offset:    f.Offset,
+					Index:     f.Index,
+					Anonymous: f.Anonymous,
+				}
+				l := &vlen{}
+				if m != nil {
+					l.order = m.order
+				}
+				c.lengths[f.Name] = l
+				if !after {
+					fields = append(fields, *nbr)
+					l.field = len(fields) - 1
+					layouts = append(layouts, field_layout{bits: -1})
+				}
 			}
-			fields = append(fields, csf)
-			fmap[f.Name+"_nbr"] = len(fields) - 1
+
+			// the vl-array itself is laid out as a pointer to its
+			// first element: its size lives in its own slot.
+			cf = fabi.new_ctype(reflect.PtrTo(f.Type.Elem()))
+		}
+		if d, ok := opts["union"]; ok {
+			if cf.Kind() != Union {
+				tag_error(f.Tag, "field is not a union")
+			}
+			df, ok := t.FieldByName(d)
+			if !ok || len(df.Index) != 1 || !is_integer(df.Type) {
+				tag_error(f.Tag, "invalid discriminator [%s]", d)
+			}
+			c.discr[f.Name] = df.Index[0]
 		}
 		csf := StructField{
 			PkgPath:   f.PkgPath,
-			Name:      f.Name,
-			Type:      gotype_to_ctype(f.Type),
-			Tag:       string(f.Tag) + " _ size of " + f.Name,
+			Name:      cname,
+			Type:      cf,
+			Tag:       string(f.Tag),
 			Offset:    f.Offset,
 			Index:     f.Index,
 			Anonymous: f.Anonymous,
 		}
 		fields = append(fields, csf)
 		fmap[f.Name] = len(fields) - 1
+		layouts = append(layouts, field_layout{
+			bits:  bit_width(f, cf),
+			align: field_align(f, opts),
+		})
+		if layouts[len(layouts)-1].bits >= 0 && abi.Pack != 0 {
+			tag_error(f.Tag, "bit-field in a packed struct")
+		}
+		if nbr != nil && after {
+			fields = append(fields, *nbr)
+			c.lengths[f.Name].field = len(fields) - 1
+			layouts = append(layouts, field_layout{bits: -1})
+		}
 	}
-	nfields = len(fields)
-	offset := uintptr(0)
+
+	// the length fields of vl-arrays may come after them
+	for _, sibling := range siblings {
+		sname, lname := sibling[0], sibling[1]
+		name = sname
+		sf, _ := t.FieldByName(sname)
+		lf, ok := t.FieldByName(lname)
+		idx, laid := fmap[lname]
+		if !ok || len(lf.Index) != 1 || !laid || layouts[idx].bits >= 0 ||
+			lf.Type.Kind() == reflect.Bool || !is_integer(lf.Type) ||
+			!is_integer(fields[idx].Type.GoType()) {
+			tag_error(sf.Tag, "invalid length field [%s]", lname)
+		}
+		l := &vlen{field: idx, shared: true}
+		if m := c.mappings[lname]; m != nil {
+			l.order = m.order
+		}
+		c.lengths[sname] = l
+		c.counted[lname] = append(c.counted[lname], sf.Index[0])
+	}
+
+	// lay out the fields following the C rules:
+	// each field starts at the next offset aligned on its own alignment
+	// (or the one of its ctypes tag, at most the pack of the ABI),
+	// the struct is aligned on its most aligned field and its size is
+	// rounded up to a multiple of that alignment (tail padding.)
+	// bit-fields are packed at the next free bit, unless they would
+	// straddle a storage unit of their type: they then start the next
+	// unit. a zero-width bit-field just skips to the next unit.
+	bits := uintptr(0) // the offset in bits of the end of the previous field
+	align := uintptr(1)
 	// println("==cstruct==",t.Name())
 	for idx := range fields {
-		fields[idx].Offset = offset
+		ft := fields[idx].Type
+		fa := uintptr(ft.FieldAlign())
+		if a := layouts[idx].align; a != 0 {
+			fa = a
+		}
+		fa = abi.pack_align(fa)
 		fields[idx].Index = []int{idx}
-		offset += fields[idx].Type.Size()
+		if w := layouts[idx].bits; w >= 0 {
+			unit := 8 * ft.Size()
+			if w == 0 {
+				bits = align_up(bits, unit)
+				fields[idx].Offset = bits / 8
+				continue
+			}
+			if bits/unit != (bits+uintptr(w)-1)/unit {
+				bits = align_up(bits, unit)
+			}
+			start := bits / unit * unit
+			fields[idx].Offset = start / 8
+			fields[idx].BitOffset = bits - start
+			fields[idx].BitSize = uintptr(w)
+			bits += uintptr(w)
+		} else {
+			offset := align_up(align_up(bits, 8)/8, fa)
+			fields[idx].Offset = offset
+			bits = 8 * (offset + ft.Size())
+		}
+		if fa > align {
+			align = fa
+		}
 	}
 	c.fields_idx = fields
 	c.fields_map = fmap
+	c.size = align_up(align_up(bits, 8)/8, align)
+	c.align = align
+	done = true
 	//println("==cstruct==",t.Name(),t.Size(),c.Size(),"[ok]")
 	return c
 }
 
+// field_layout holds the layout constraints of a struct field
+type field_layout struct {
+	bits  int     // the width of a bit-field, -1 for other fields
+	align uintptr // the alignment of the field, 0 for its natural one
+}
+
 func (t *cstruct_type) Field(i int) StructField {
 	return t.fields_idx[i]
 }
 
+func (t *cstruct_type) NumField() int {
+	return len(t.fields_idx)
+}
+
 func (t *cstruct_type) Size() uintptr {
-	sz := uintptr(0)
-	for _, v := range t.fields_idx {
-		// FIXME: alignment ?
-		sz += v.Type.Size()
+	return t.size
+}
+
+func (t *cstruct_type) Align() int {
+	return int(t.align)
+}
+
+func (t *cstruct_type) FieldAlign() int {
+	return int(t.align)
+}
+
+// align_up rounds offset up to the next multiple of align
+func align_up(offset, align uintptr) uintptr {
+	if align <= 1 {
+		return offset
 	}
-	return sz
+	return (offset + align - 1) / align * align
 }
 
+// sizes of the scalars which do not depend on the target ABI.
+// int, uint, uintptr and pointers are PtrSize-bytes wide.
 const (
-	sz_bool = int(unsafe.Sizeof(bool(true)))
+	sz_bool = 1
 
-	sz_int   = int(unsafe.Sizeof(int(0)))
-	sz_int8  = int(unsafe.Sizeof(int8(0)))
-	sz_int16 = int(unsafe.Sizeof(int16(0)))
-	sz_int32 = int(unsafe.Sizeof(int32(0)))
-	sz_int64 = int(unsafe.Sizeof(int64(0)))
+	sz_int8  = 1
+	sz_int16 = 2
+	sz_int32 = 4
+	sz_int64 = 8
 
-	sz_uint   = int(unsafe.Sizeof(uint(0)))
-	sz_uint8  = int(unsafe.Sizeof(uint8(0)))
-	sz_uint16 = int(unsafe.Sizeof(uint16(0)))
-	sz_uint32 = int(unsafe.Sizeof(uint32(0)))
-	sz_uint64 = int(unsafe.Sizeof(uint64(0)))
+	sz_uint8  = 1
+	sz_uint16 = 2
+	sz_uint32 = 4
+	sz_uint64 = 8
 
-	sz_uintptr = int(unsafe.Sizeof(uintptr(0)))
+	sz_float32 = 4
+	sz_float64 = 8
+)
 
-	sz_float32 = int(unsafe.Sizeof(float32(0)))
-	sz_float64 = int(unsafe.Sizeof(float64(0)))
+// byte_order returns the byte order of the scalars at the cursor:
+// the one of the target ABI, unless overridden by a struct tag
+func (v *Value) byte_order() binary.ByteOrder {
+	if v.order != nil {
+		return v.order
+	}
+	return v.abi.ByteOrder
+}
+
+// put_uint writes the n low-order bytes of x at the cursor,
+// in the byte order of the target ABI
+func (v *Value) put_uint(x uint64, n int) {
+	b := v.b[v.idx : v.idx+n]
+	switch n {
+	case 1:
+		b[0] = byte(x)
+	case 2:
+		v.byte_order().PutUint16(b, uint16(x))
+	case 4:
+		v.byte_order().PutUint32(b, uint32(x))
+	case 8:
+		v.byte_order().PutUint64(b, x)
+	default:
+		panic(fmt.Sprintf("ctypes: invalid scalar size [%d]", n))
+	}
+	v.idx += n
+}
+
+// get_uint reads a n-bytes unsigned integer at the cursor,
+// in the byte order of the target ABI
+func (v *Value) get_uint(n int) uint64 {
+	b := v.b[v.idx : v.idx+n]
+	x := uint64(0)
+	switch n {
+	case 1:
+		x = uint64(b[0])
+	case 2:
+		x = uint64(v.byte_order().Uint16(b))
+	case 4:
+		x = uint64(v.byte_order().Uint32(b))
+	case 8:
+		x = v.byte_order().Uint64(b)
+	default:
+		panic(fmt.Sprintf("ctypes: invalid scalar size [%d]", n))
+	}
+	v.idx += n
+	return x
+}
 
-	sz_complex64  = int(unsafe.Sizeof(complex(float32(0), float32(0))))
-	sz_complex128 = int(unsafe.Sizeof(complex(float64(0), float64(0))))
-)
+// get_int reads a n-bytes signed integer at the cursor
+func (v *Value) get_int(n int) int64 {
+	shift := uint(64 - 8*n)
+	return int64(v.get_uint(n)<<shift) >> shift
+}
+
+// ptr_size returns the size of a pointer (and of a Go int) on the target
+func (v *Value) ptr_size() int {
+	return int(v.abi.PtrSize)
+}
 
 // An Encoder is bound to a particular reflect.Type and knows how to
 // convert a Go value into a ctypes.Value
@@ -441,14 +1017,27 @@ func NewEncoder(v *Value) Encoder {
 }
 
 // Encode a Go value into a ctypes.Value
-func (e *ctype_encoder) Encode(v interface{}) (*Value, error) {
+func (e *ctype_encoder) Encode(v interface{}) (cv *Value, err error) {
 	rv := follow_ptr(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		return nil, &UnsupportedTypeError{}
+	}
 	rt := rv.Type()
+	if e.v.is_closed() {
+		return nil, ErrClosed
+	}
 	if rt != e.v.Type().GoType() {
 		return nil, fmt.Errorf("cannot encode this type [%s]", rt.String())
 	}
+	defer catch_error(rt, &err)
 
 	e.v.Reset()
+	e.v.track_pointers(rv)
+	defer e.v.untrack_pointers()
+	if ct, ok := e.v.t.(*cchars_type); ok {
+		encode_chars(e.v, rv, ct)
+		return e.v, nil
+	}
 	encode_value(e.v, rv)
 	return e.v, nil
 }
@@ -457,151 +1046,138 @@ type enc_op func(v *Value, p unsafe.Pointer)
 
 var enc_op_table []enc_op
 
-func encode_noop(v *Value, p unsafe.Pointer) {
-	panic("noop!")
-}
-
 func encode_bool(v *Value, p unsafe.Pointer) {
-	src := (*bool)(p)
-	dst := (*bool)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_bool
+	x := uint64(0)
+	if *(*bool)(p) {
+		x = 1
+	}
+	v.put_uint(x, sz_bool)
 }
 
 func encode_int(v *Value, p unsafe.Pointer) {
-	src := (*int)(p)
-	dst := (*int)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_int
+	v.put_uint(uint64(*(*int)(p)), v.ptr_size())
 }
 
 func encode_int8(v *Value, p unsafe.Pointer) {
-	src := (*int8)(p)
-	dst := (*int8)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_int8
+	v.put_uint(uint64(*(*int8)(p)), sz_int8)
 }
 
 func encode_int16(v *Value, p unsafe.Pointer) {
-	src := (*int16)(p)
-	dst := (*int16)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_int16
+	v.put_uint(uint64(*(*int16)(p)), sz_int16)
 }
 
 func encode_int32(v *Value, p unsafe.Pointer) {
-	src := (*int32)(p)
-	dst := (*int32)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_int32
+	v.put_uint(uint64(*(*int32)(p)), sz_int32)
 }
 
 func encode_int64(v *Value, p unsafe.Pointer) {
-	src := (*int64)(p)
-	dst := (*int64)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_int64
+	v.put_uint(uint64(*(*int64)(p)), sz_int64)
 }
 
 func encode_uint(v *Value, p unsafe.Pointer) {
-	src := (*uint)(p)
-	dst := (*uint)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uint
+	v.put_uint(uint64(*(*uint)(p)), v.ptr_size())
 }
 
 func encode_uint8(v *Value, p unsafe.Pointer) {
-	src := (*uint8)(p)
-	dst := (*uint8)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uint8
+	v.put_uint(uint64(*(*uint8)(p)), sz_uint8)
 }
 
 func encode_uint16(v *Value, p unsafe.Pointer) {
-	src := (*uint16)(p)
-	dst := (*uint16)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uint16
+	v.put_uint(uint64(*(*uint16)(p)), sz_uint16)
 }
 
 func encode_uint32(v *Value, p unsafe.Pointer) {
-	src := (*uint32)(p)
-	dst := (*uint32)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uint32
+	v.put_uint(uint64(*(*uint32)(p)), sz_uint32)
 }
 
 func encode_uint64(v *Value, p unsafe.Pointer) {
-	src := (*uint64)(p)
-	dst := (*uint64)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uint64
+	v.put_uint(*(*uint64)(p), sz_uint64)
 }
 
 func encode_uintptr(v *Value, p unsafe.Pointer) {
-	src := (*uintptr)(p)
-	dst := (*uintptr)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uintptr
+	v.put_uint(uint64(*(*uintptr)(p)), v.ptr_size())
 }
 
 func encode_float32(v *Value, p unsafe.Pointer) {
-	src := (*float32)(p)
-	dst := (*float32)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_float32
+	v.put_uint(uint64(math.Float32bits(*(*float32)(p))), sz_float32)
 }
 
 func encode_float64(v *Value, p unsafe.Pointer) {
-	src := (*float64)(p)
-	dst := (*float64)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_float64
+	v.put_uint(math.Float64bits(*(*float64)(p)), sz_float64)
 }
 
 func encode_complex64(v *Value, p unsafe.Pointer) {
-	src := (*complex64)(p)
-	dst := (*complex64)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_complex64
+	src := *(*complex64)(p)
+	re, im := real(src), imag(src)
+	encode_float32(v, unsafe.Pointer(&re))
+	encode_float32(v, unsafe.Pointer(&im))
 }
 
 func encode_complex128(v *Value, p unsafe.Pointer) {
-	src := (*complex128)(p)
-	dst := (*complex128)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_complex128
+	src := *(*complex128)(p)
+	re, im := real(src), imag(src)
+	encode_float64(v, unsafe.Pointer(&re))
+	encode_float64(v, unsafe.Pointer(&im))
 }
 
 func encode_array(v *Value, p unsafe.Pointer) {
 	arr := (*reflect.Value)(p)
-	op := enc_op_table[arr.Type().Elem().Kind()]
 
 	length := arr.Len()
 	//fmt.Printf("--array-- [%v] [%v]\n", length, arr.Type().Elem().Kind())
 	for i := 0; i < length; i++ {
-		src := unsafe.Pointer(arr.Index(i).UnsafeAddr())
-		op(v, src)
+		encode_value(v, arr.Index(i))
 	}
 }
 
 func encode_ptr(v *Value, p unsafe.Pointer) {
-	src := (*uintptr)(p)
-	dst := (*uintptr)(unsafe.Pointer(&v.b[v.idx]))
-	*dst = *src
-	v.idx += sz_uintptr
+	v.put_uint(uint64(*(*uintptr)(p)), v.ptr_size())
+}
+
+// encode_pointer encodes a Go pointer: in deep mode, the pointed-to value
+// is copied into C memory (once, if shared) and nil pointers become NULL
+func encode_pointer(v *Value, p unsafe.Pointer) {
+	rv := (*reflect.Value)(p)
+	addr := rv.Pointer()
+	if v.deep() && addr != 0 {
+		addr = uintptr(v.encode_pointee(rv.Elem()))
+	}
+	encode_ptr(v, unsafe.Pointer(&addr))
+}
+
+// slice_data returns the address to store for the data of a Go slice:
+// in deep mode, the elements are copied into C memory
+func slice_data(v *Value, rv reflect.Value) uintptr {
+	if !v.deep() {
+		return rv.Pointer()
+	}
+	if rv.Len() == 0 {
+		return 0
+	}
+	return uintptr(v.encode_slice_block(rv))
 }
 
 func encode_slice(v *Value, p unsafe.Pointer) {
-	slice := (*reflect.SliceHeader)(p)
-	encode_int(v, unsafe.Pointer(&slice.Len))
-	encode_ptr(v, unsafe.Pointer(&slice.Data))
+	rv := (*reflect.Value)(p)
+	n := rv.Len()
+	data := slice_data(v, *rv)
+	encode_int(v, unsafe.Pointer(&n))
+	encode_ptr(v, unsafe.Pointer(&data))
 }
 
 func encode_string(v *Value, p unsafe.Pointer) {
 	s := *(*string)(p)
-	cstr := C.CString(s)
-	v.cstrings[v.idx] = cstr
+	cstr := v.c_string(s)
+	switch {
+	case v.arena != nil:
+		// released with the arena
+	case v.foreign:
+		// belongs to the owner of the foreign memory (see ValueAt)
+	case v.nested > 0:
+		v.cmems = append(v.cmems, unsafe.Pointer(cstr))
+	default:
+		v.cstrings[v.idx] = cstr
+	}
 	// println("--encode-string...")
 	// println(v.idx)
 	// println(cstr, *(*byte)((unsafe.Pointer)(cstr)))
@@ -615,11 +1191,95 @@ func encode_string(v *Value, p unsafe.Pointer) {
 
 func encode_struct(v *Value, p unsafe.Pointer) {
 	rv := (*reflect.Value)(p)
+	rt := rv.Type()
+	if ut, ok := v.abi.gotype_to_ctype(rt).(*cunion_type); ok {
+		encode_union(v, *rv, ut, ut.default_member())
+		return
+	}
+	ct := v.abi.gotype_to_ctype(rt).(*cstruct_type)
+	base := v.idx
+	name := ""
+	defer field_error(&name)
 	nfields := rv.NumField()
 	for i := 0; i < nfields; i++ {
-		f := rv.Field(i)
-		encode_value(v, f)
+		name = rt.Field(i).Name
+		if _, ok := ct.fields_map[name]; !ok || name == "_" {
+			// skipped, padding or zero-width bit-field
+			continue
+		}
+		encode_field(v, *rv, ct, i, base)
+	}
+	v.idx = base + int(ct.Size())
+}
+
+// encode_field encodes the i-th field of the Go struct rv, laid out as ct
+// at the offset base
+func encode_field(v *Value, rv reflect.Value, ct *cstruct_type, i, base int) {
+	f := rv.Field(i)
+	name := rv.Type().Field(i).Name
+	sf := &ct.fields_idx[ct.fields_map[name]]
+	m := ct.mappings[name]
+	if m != nil && m.order != nil {
+		order := v.order
+		v.order = m.order
+		defer func() { v.order = order }()
+	}
+	if a := sf.Type.ABI(); a != v.abi {
+		// the field is laid out for a packed variant of the ABI
+		abi := v.abi
+		v.abi = a
+		defer func() { v.abi = abi }()
 	}
+	v.idx = base + int(sf.Offset)
+	if sf.BitSize > 0 {
+		encode_bits(v, f, sf)
+		return
+	}
+	if d, ok := ct.discr[name]; ok {
+		ut := sf.Type.(*cunion_type)
+		encode_union(v, f, ut, ut.member(int_of(rv.Field(d))))
+		return
+	}
+	if f.Kind() == reflect.Slice {
+		// the size of the vl-array goes into its own slot, unless it is
+		// a sibling field, the vl-array itself is a pointer to its data
+		if l := ct.lengths[name]; !l.shared {
+			encode_len(v, ct, l, base, f.Len())
+		}
+		data := slice_data(v, f)
+		v.idx = base + int(sf.Offset)
+		encode_ptr(v, unsafe.Pointer(&data))
+		return
+	}
+	if slices, ok := ct.counted[name]; ok {
+		// the field holds the length of vl-arrays
+		n := rv.Field(slices[0]).Len()
+		for _, j := range slices[1:] {
+			if rv.Field(j).Len() != n {
+				panic(&LengthError{Len: n, Other: rv.Field(j).Len()})
+			}
+		}
+		f = reflect.New(f.Type()).Elem()
+		set_int(f, int64(n))
+	}
+	if m != nil {
+		encode_mapped(v, f, m)
+		return
+	}
+	encode_value(v, f)
+}
+
+// encode_len writes the length n of a vl-array into its slot l
+// of the struct ct at the offset base
+func encode_len(v *Value, ct *cstruct_type, l *vlen, base, n int) {
+	sf := &ct.fields_idx[l.field]
+	order := v.order
+	v.order = l.order
+	defer func() { v.order = order }()
+	x := reflect.New(sf.Type.GoType()).Elem()
+	set_int(x, int64(n))
+	v.idx = base + int(sf.Offset)
+	encode_value(v, x)
 }
 
 func encode_value(cv *Value, rv reflect.Value) {
@@ -627,14 +1287,16 @@ func encode_value(cv *Value, rv reflect.Value) {
 	kind := rv.Type().Kind()
 	op := enc_op_table[kind]
 	switch kind {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map:
+		panic(&UnsupportedTypeError{Type: rv.Type()})
 	default:
 		op(cv, unsafe.Pointer(rv.UnsafeAddr()))
 	case reflect.Array:
 		op(cv, unsafe.Pointer(&rv))
 	case reflect.Ptr:
-		op(cv, unsafe.Pointer(rv.Pointer()))
+		op(cv, unsafe.Pointer(&rv))
 	case reflect.Slice:
-		op(cv, unsafe.Pointer(rv.UnsafeAddr()))
+		op(cv, unsafe.Pointer(&rv))
 	case reflect.Struct:
 		op(cv, unsafe.Pointer(&rv))
 	case reflect.String:
@@ -661,14 +1323,27 @@ func NewDecoder(v *Value) Decoder {
 }
 
 // Decode a ctypes.Value into a Go value
-func (d *ctype_decoder) Decode(v interface{}) (*Value, error) {
+func (d *ctype_decoder) Decode(v interface{}) (cv *Value, err error) {
 	rv := follow_ptr(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		return nil, &UnsupportedTypeError{}
+	}
 	rt := rv.Type()
+	if d.v.is_closed() {
+		return nil, ErrClosed
+	}
 	if rt != d.v.Type().GoType() {
 		return nil, fmt.Errorf("cannot decode this type [%s]", rt.String())
 	}
+	defer catch_error(rt, &err)
 	//d.v.Reset()
 	d.v.idx = 0
+	d.v.track_pointers(rv)
+	defer d.v.untrack_pointers()
+	if ct, ok := d.v.t.(*cchars_type); ok {
+		decode_chars(d.v, rv, ct)
+		return d.v, nil
+	}
 	decode_value(d.v, rv)
 	return d.v, nil
 }
@@ -677,166 +1352,260 @@ type dec_op func(v *Value, p unsafe.Pointer)
 
 var dec_op_table []dec_op
 
-func decode_noop(v *Value, p unsafe.Pointer) {
-	panic("noop!")
-}
-
 func decode_bool(v *Value, p unsafe.Pointer) {
-	src := (*bool)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*bool)(p)
-	*dst = *src
-	v.idx += sz_bool
+	*(*bool)(p) = v.get_uint(sz_bool) != 0
 }
 
 func decode_int(v *Value, p unsafe.Pointer) {
-	src := (*int)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*int)(p)
-	*dst = *src
-	v.idx += sz_int
+	*(*int)(p) = int(v.get_int(v.ptr_size()))
 }
 
 func decode_int8(v *Value, p unsafe.Pointer) {
-	src := (*int8)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*int8)(p)
-	*dst = *src
-	v.idx += sz_int8
+	*(*int8)(p) = int8(v.get_int(sz_int8))
 }
 
 func decode_int16(v *Value, p unsafe.Pointer) {
-	src := (*int16)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*int16)(p)
-	*dst = *src
-	v.idx += sz_int16
+	*(*int16)(p) = int16(v.get_int(sz_int16))
 }
 
 func decode_int32(v *Value, p unsafe.Pointer) {
-	src := (*int32)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*int32)(p)
-	*dst = *src
-	v.idx += sz_int32
+	*(*int32)(p) = int32(v.get_int(sz_int32))
 }
 
 func decode_int64(v *Value, p unsafe.Pointer) {
-	src := (*int64)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*int64)(p)
-	*dst = *src
-	v.idx += sz_int64
+	*(*int64)(p) = v.get_int(sz_int64)
 }
 
 func decode_uint(v *Value, p unsafe.Pointer) {
-	src := (*uint)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uint)(p)
-	*dst = *src
-	v.idx += sz_uint
+	*(*uint)(p) = uint(v.get_uint(v.ptr_size()))
 }
 
 func decode_uint8(v *Value, p unsafe.Pointer) {
-	src := (*uint8)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uint8)(p)
-	*dst = *src
-	v.idx += sz_uint8
+	*(*uint8)(p) = uint8(v.get_uint(sz_uint8))
 }
 
 func decode_uint16(v *Value, p unsafe.Pointer) {
-	src := (*uint16)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uint16)(p)
-	*dst = *src
-	v.idx += sz_uint16
+	*(*uint16)(p) = uint16(v.get_uint(sz_uint16))
 }
 
 func decode_uint32(v *Value, p unsafe.Pointer) {
-	src := (*uint32)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uint32)(p)
-	*dst = *src
-	v.idx += sz_uint32
+	*(*uint32)(p) = uint32(v.get_uint(sz_uint32))
 }
 
 func decode_uint64(v *Value, p unsafe.Pointer) {
-	src := (*uint64)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uint64)(p)
-	*dst = *src
-	v.idx += sz_uint64
+	*(*uint64)(p) = v.get_uint(sz_uint64)
 }
 
 func decode_uintptr(v *Value, p unsafe.Pointer) {
-	src := (*uintptr)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uintptr)(p)
-	*dst = *src
-	v.idx += sz_uintptr
+	*(*uintptr)(p) = uintptr(v.get_uint(v.ptr_size()))
 }
 
 func decode_float32(v *Value, p unsafe.Pointer) {
-	src := (*float32)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*float32)(p)
-	*dst = *src
-	v.idx += sz_float32
+	*(*float32)(p) = math.Float32frombits(uint32(v.get_uint(sz_float32)))
 }
 
 func decode_float64(v *Value, p unsafe.Pointer) {
-	src := (*float64)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*float64)(p)
-	*dst = *src
-	v.idx += sz_float64
+	*(*float64)(p) = math.Float64frombits(v.get_uint(sz_float64))
 }
 
 func decode_complex64(v *Value, p unsafe.Pointer) {
-	src := (*complex64)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*complex64)(p)
-	*dst = *src
-	v.idx += sz_complex64
+	var re, im float32
+	decode_float32(v, unsafe.Pointer(&re))
+	decode_float32(v, unsafe.Pointer(&im))
+	*(*complex64)(p) = complex(re, im)
 }
 
 func decode_complex128(v *Value, p unsafe.Pointer) {
-	src := (*complex128)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*complex128)(p)
-	*dst = *src
-	v.idx += sz_complex128
+	var re, im float64
+	decode_float64(v, unsafe.Pointer(&re))
+	decode_float64(v, unsafe.Pointer(&im))
+	*(*complex128)(p) = complex(re, im)
 }
 
 func decode_array(v *Value, p unsafe.Pointer) {
 	arr := (*reflect.Value)(p)
-	op := dec_op_table[arr.Type().Elem().Kind()]
 
 	length := arr.Len()
 	//fmt.Printf("<--array-- [%d] [%v]\n", length, arr.Type().Elem().Kind())
 	for i := 0; i < length; i++ {
-		dst := unsafe.Pointer(arr.Index(i).UnsafeAddr())
-		op(v, dst)
+		decode_value(v, arr.Index(i))
 	}
 }
 
 func decode_ptr(v *Value, p unsafe.Pointer) {
-	src := (*uintptr)(unsafe.Pointer(&v.b[v.idx]))
-	dst := (*uintptr)(p)
-	*dst = *src
-	v.idx += sz_uintptr
+	*(*uintptr)(p) = uintptr(v.get_uint(v.ptr_size()))
+}
+
+// decode_pointer decodes a Go pointer: in deep mode, a new Go value is
+// allocated and decoded from the pointed-to C memory.
+// The pointers of an ABI other than the Host one are decoded as nil.
+func decode_pointer(v *Value, p unsafe.Pointer) {
+	rv := *(*reflect.Value)(p)
+	if !v.abi.host_pointers() {
+		// the address is not meaningful here (and maybe truncated):
+		// it can neither be followed nor stored in a Go pointer
+		v.idx += v.ptr_size()
+		writable(rv).Set(reflect.Zero(rv.Type()))
+		return
+	}
+	if !v.deep() {
+		decode_ptr(v, unsafe.Pointer(rv.UnsafeAddr()))
+		return
+	}
+	var addr unsafe.Pointer
+	decode_ptr(v, unsafe.Pointer(&addr))
+	var ptr unsafe.Pointer
+	if addr != nil {
+		ptr = v.decode_pointee(addr, rv.Type().Elem())
+	}
+	*(*unsafe.Pointer)(unsafe.Pointer(rv.UnsafeAddr())) = ptr
 }
 
 func decode_slice(v *Value, p unsafe.Pointer) {
-	slice := (*reflect.SliceHeader)(p)
-	decode_int(v, unsafe.Pointer(&slice.Len))
-	//println("-->", slice.Len)
-	decode_ptr(v, unsafe.Pointer(&slice.Data))
+	rv := *(*reflect.Value)(p)
+	n := 0
+	var data unsafe.Pointer
+	decode_int(v, unsafe.Pointer(&n))
+	decode_ptr(v, unsafe.Pointer(&data))
+	decode_slice_data(v, rv, n, data)
+}
+
+// decode_slice_data stores into the Go slice rv a copy of the n elements
+// at data, so that it does not alias the memory of the C value.
+// Elements in C memory are decoded one by one, elements of a Go-allocated
+// Value are still those of the encoded Go slice and are copied as is.
+func decode_slice_data(v *Value, rv reflect.Value, n int, data unsafe.Pointer) {
+	dst := writable(rv)
+	if n <= 0 || data == nil || !v.abi.host_pointers() {
+		dst.Set(reflect.Zero(rv.Type()))
+		return
+	}
+	s := reflect.MakeSlice(rv.Type(), n, n)
+	if v.deep() {
+		v.decode_slice_block(data, s)
+	} else {
+		src := reflect.New(rv.Type()).Elem()
+		h := (*reflect.SliceHeader)(unsafe.Pointer(src.UnsafeAddr()))
+		h.Data = uintptr(data)
+		h.Len = n
+		h.Cap = n
+		reflect.Copy(s, src)
+	}
+	dst.Set(s)
 }
 
 func decode_string(v *Value, p unsafe.Pointer) {
+	var cstr cstring
+	if v.abi.host_pointers() {
+		decode_ptr(v, unsafe.Pointer(&cstr))
+	} else {
+		// the pointers of this ABI are not meaningful here:
+		// only the strings this Value encoded itself can be decoded
+		cstr = v.cstrings[v.idx]
+		v.idx += v.ptr_size()
+	}
+	*(*string)(p) = v.go_string(cstr)
+}
 
-	cstr := v.cstrings[v.idx]
-	s := C.GoString(cstr)
-	src := (*reflect.StringHeader)(unsafe.Pointer(&s))
-	dst := (*reflect.StringHeader)(p)
-	dst.Data = src.Data
-	dst.Len = src.Len
-	v.idx += sz_uintptr
+// go_string copies the NUL-terminated C-string s into a Go string,
+// reading at most v.strmax bytes if set. A NULL C-string gives "".
+func (v *Value) go_string(s cstring) string {
+	if s == nil {
+		return ""
+	}
+	if v.strmax <= 0 {
+		return C.GoString(s)
+	}
+	n := C.strnlen(s, C.size_t(v.strmax))
+	return C.GoStringN(s, C.int(n))
 }
 
 func decode_struct(v *Value, p unsafe.Pointer) {
 	rv := (*reflect.Value)(p)
+	rt := rv.Type()
+	if ut, ok := v.abi.gotype_to_ctype(rt).(*cunion_type); ok {
+		decode_union(v, *rv, ut, ut.default_member())
+		return
+	}
+	ct := v.abi.gotype_to_ctype(rt).(*cstruct_type)
+	base := v.idx
+	name := ""
+	defer field_error(&name)
+	var unions []int // the unions driven by a discriminator, decoded last
 	nfields := rv.NumField()
 	for i := 0; i < nfields; i++ {
-		f := rv.Field(i)
-		decode_value(v, f)
+		name = rt.Field(i).Name
+		if _, ok := ct.fields_map[name]; !ok || name == "_" {
+			// skipped, padding or zero-width bit-field
+			continue
+		}
+		if _, ok := ct.discr[name]; ok {
+			unions = append(unions, i)
+			continue
+		}
+		decode_field(v, *rv, ct, i, base)
 	}
+	for _, i := range unions {
+		name = rt.Field(i).Name
+		decode_field(v, *rv, ct, i, base)
+	}
+	v.idx = base + int(ct.Size())
+}
+
+// decode_field decodes the i-th field of the Go struct rv, laid out as ct
+// at the offset base
+func decode_field(v *Value, rv reflect.Value, ct *cstruct_type, i, base int) {
+	f := rv.Field(i)
+	name := rv.Type().Field(i).Name
+	sf := &ct.fields_idx[ct.fields_map[name]]
+	m := ct.mappings[name]
+	if m != nil && m.order != nil {
+		order := v.order
+		v.order = m.order
+		defer func() { v.order = order }()
+	}
+	if a := sf.Type.ABI(); a != v.abi {
+		// the field is laid out for a packed variant of the ABI
+		abi := v.abi
+		v.abi = a
+		defer func() { v.abi = abi }()
+	}
+	v.idx = base + int(sf.Offset)
+	if sf.BitSize > 0 {
+		decode_bits(v, f, sf)
+		return
+	}
+	if d, ok := ct.discr[name]; ok {
+		ut := sf.Type.(*cunion_type)
+		decode_union(v, f, ut, ut.member(int_of(rv.Field(d))))
+		return
+	}
+	if f.Kind() == reflect.Slice {
+		var data unsafe.Pointer
+		n := decode_len(v, ct, ct.lengths[name], base)
+		v.idx = base + int(sf.Offset)
+		decode_ptr(v, unsafe.Pointer(&data))
+		decode_slice_data(v, f, n, data)
+		return
+	}
+	if m != nil {
+		decode_mapped(v, f, m)
+		return
+	}
+	decode_value(v, f)
+}
+
+// decode_len reads the length of a vl-array from its slot l
+// of the struct ct at the offset base
+func decode_len(v *Value, ct *cstruct_type, l *vlen, base int) int {
+	sf := &ct.fields_idx[l.field]
+	order := v.order
+	v.order = l.order
+	defer func() { v.order = order }()
+	x := reflect.New(sf.Type.GoType()).Elem()
+	v.idx = base + int(sf.Offset)
+	decode_value(v, x)
+	return int(int_of(x))
 }
 
 func decode_value(cv *Value, rv reflect.Value) {
@@ -844,6 +1613,8 @@ func decode_value(cv *Value, rv reflect.Value) {
 	kind := rv.Type().Kind()
 	op := dec_op_table[kind]
 	switch kind {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map:
+		panic(&UnsupportedTypeError{Type: rv.Type()})
 	default:
 		//println("-->",kind.String())
 		op(cv, unsafe.Pointer(rv.UnsafeAddr()))
@@ -852,10 +1623,10 @@ func decode_value(cv *Value, rv reflect.Value) {
 		op(cv, unsafe.Pointer(&rv))
 	case reflect.Ptr:
 		//fmt.Printf("--> ptr\n")
-		op(cv, unsafe.Pointer(rv.UnsafeAddr()))
+		op(cv, unsafe.Pointer(&rv))
 		//fmt.Printf("<-- ptr\n")
 	case reflect.Slice:
-		op(cv, unsafe.Pointer(rv.UnsafeAddr()))
+		op(cv, unsafe.Pointer(&rv))
 	case reflect.Struct:
 		op(cv, unsafe.Pointer(&rv))
 	case reflect.String:
@@ -868,62 +1639,54 @@ func decode_value(cv *Value, rv reflect.Value) {
 
 func init() {
 	enc_op_table = []enc_op{
-		reflect.Bool:       encode_bool,
-		reflect.Int:        encode_int,
-		reflect.Int8:       encode_int8,
-		reflect.Int16:      encode_int16,
-		reflect.Int32:      encode_int32,
-		reflect.Int64:      encode_int64,
-		reflect.Uint:       encode_uint,
-		reflect.Uint8:      encode_uint8,
-		reflect.Uint16:     encode_uint16,
-		reflect.Uint32:     encode_uint32,
-		reflect.Uint64:     encode_uint64,
-		reflect.Uintptr:    encode_uintptr,
-		reflect.Float32:    encode_float32,
-		reflect.Float64:    encode_float64,
-		reflect.Complex64:  encode_complex64,
-		reflect.Complex128: encode_complex128,
-		reflect.Array:      encode_array,
-		reflect.Chan:       encode_noop,
-		reflect.Func:       encode_noop,
-		reflect.Interface:  encode_noop,
-		reflect.Map:        encode_noop,
-		reflect.Ptr:        encode_ptr,
-		reflect.Slice:      encode_slice,
-		reflect.String:     encode_string,
-		reflect.Struct:     encode_struct,
+		reflect.Bool:          encode_bool,
+		reflect.Int:           encode_int,
+		reflect.Int8:          encode_int8,
+		reflect.Int16:         encode_int16,
+		reflect.Int32:         encode_int32,
+		reflect.Int64:         encode_int64,
+		reflect.Uint:          encode_uint,
+		reflect.Uint8:         encode_uint8,
+		reflect.Uint16:        encode_uint16,
+		reflect.Uint32:        encode_uint32,
+		reflect.Uint64:        encode_uint64,
+		reflect.Uintptr:       encode_uintptr,
+		reflect.Float32:       encode_float32,
+		reflect.Float64:       encode_float64,
+		reflect.Complex64:     encode_complex64,
+		reflect.Complex128:    encode_complex128,
+		reflect.Array:         encode_array,
+		reflect.Ptr:           encode_pointer,
+		reflect.Slice:         encode_slice,
+		reflect.String:        encode_string,
+		reflect.Struct:        encode_struct,
+		reflect.UnsafePointer: encode_uintptr,
 	}
 
 	dec_op_table = []dec_op{
-		reflect.Bool:       decode_bool,
-		reflect.Int:        decode_int,
-		reflect.Int8:       decode_int8,
-		reflect.Int16:      decode_int16,
-		reflect.Int32:      decode_int32,
-		reflect.Int64:      decode_int64,
-		reflect.Uint:       decode_uint,
-		reflect.Uint8:      decode_uint8,
-		reflect.Uint16:     decode_uint16,
-		reflect.Uint32:     decode_uint32,
-		reflect.Uint64:     decode_uint64,
-		reflect.Uintptr:    decode_uintptr,
-		reflect.Float32:    decode_float32,
-		reflect.Float64:    decode_float64,
-		reflect.Complex64:  decode_complex64,
-		reflect.Complex128: decode_complex128,
-		reflect.Array:      decode_array,
-		reflect.Chan:       decode_noop,
-		reflect.Func:       decode_noop,
-		reflect.Interface:  decode_noop,
-		reflect.Map:        decode_noop,
-		reflect.Ptr:        decode_ptr,
-		reflect.Slice:      decode_slice,
-		reflect.String:     decode_string,
-		reflect.Struct:     decode_struct,
-	}
-
-	ctypeds = make(map[reflect.Type]Type)
+		reflect.Bool:          decode_bool,
+		reflect.Int:           decode_int,
+		reflect.Int8:          decode_int8,
+		reflect.Int16:         decode_int16,
+		reflect.Int32:         decode_int32,
+		reflect.Int64:         decode_int64,
+		reflect.Uint:          decode_uint,
+		reflect.Uint8:         decode_uint8,
+		reflect.Uint16:        decode_uint16,
+		reflect.Uint32:        decode_uint32,
+		reflect.Uint64:        decode_uint64,
+		reflect.Uintptr:       decode_uintptr,
+		reflect.Float32:       decode_float32,
+		reflect.Float64:       decode_float64,
+		reflect.Complex64:     decode_complex64,
+		reflect.Complex128:    decode_complex128,
+		reflect.Array:         decode_array,
+		reflect.Ptr:           decode_pointer,
+		reflect.Slice:         decode_slice,
+		reflect.String:        decode_string,
+		reflect.Struct:        decode_struct,
+		reflect.UnsafePointer: decode_uintptr,
+	}
 }
 
 // EOF
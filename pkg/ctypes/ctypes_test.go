@@ -0,0 +1,283 @@
+package ctypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+func encode(t *testing.T, v *Value, x interface{}) {
+	if _, err := NewEncoder(v).Encode(x); err != nil {
+		t.Fatalf("encode %T: %v", x, err)
+	}
+}
+
+func decode(t *testing.T, v *Value, x interface{}) {
+	if _, err := NewDecoder(v).Decode(x); err != nil {
+		t.Fatalf("decode %T: %v", x, err)
+	}
+}
+
+type test_order struct {
+	A uint16
+	B uint32
+	C int64
+	F float32
+	X complex64
+}
+
+func TestByteOrder(t *testing.T) {
+	in := test_order{0x0102, 0x03040506, -2, 1.5, complex(2, -3)}
+	for _, abi := range []*ABI{LP64, LP64BE, LP64.WithByteOrder(binary.BigEndian)} {
+		order := abi.ByteOrder
+		want := make([]byte, 32)
+		order.PutUint16(want[0:], in.A)
+		order.PutUint32(want[4:], in.B)
+		order.PutUint64(want[8:], uint64(in.C))
+		order.PutUint32(want[16:], math.Float32bits(in.F))
+		order.PutUint32(want[20:], math.Float32bits(real(in.X)))
+		order.PutUint32(want[24:], math.Float32bits(imag(in.X)))
+
+		v := abi.ValueOf(&in)
+		encode(t, v, &in)
+		if !bytes.Equal(v.Buffer(), want) {
+			t.Errorf("%s: encoded % x, want % x", abi, v.Buffer(), want)
+		}
+		var out test_order
+		decode(t, v, &out)
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("%s: decoded %+v, want %+v", abi, out, in)
+		}
+	}
+
+	// Go ints have the size of the pointers of the target
+	x := 0x01020304
+	v := ILP32BE.ValueOf(&x)
+	encode(t, v, &x)
+	if want := []byte{1, 2, 3, 4}; !bytes.Equal(v.Buffer(), want) {
+		t.Errorf("%s: encoded % x, want % x", ILP32BE, v.Buffer(), want)
+	}
+}
+
+type (
+	test_bad struct {
+		A  int32
+		In test_bad_in
+	}
+	test_bad_in struct {
+		F float64
+		M map[string]int
+	}
+)
+
+func TestErrors(t *testing.T) {
+	for _, test := range []struct {
+		v    interface{}
+		typ  reflect.Type
+		path string
+		msg  string
+	}{
+		{
+			v:   make(chan int),
+			typ: reflect.TypeOf(make(chan int)),
+			msg: "ctypes: unsupported type [chan int]",
+		},
+		{
+			v:    test_bad{},
+			typ:  reflect.TypeOf(map[string]int{}),
+			path: "test_bad.In.M",
+			msg:  "ctypes: unsupported type [map[string]int] for field test_bad.In.M",
+		},
+		{
+			v:    [2]test_bad_in{},
+			typ:  reflect.TypeOf(map[string]int{}),
+			path: "[2]ctypes.test_bad_in.M",
+			msg:  "ctypes: unsupported type [map[string]int] for field [2]ctypes.test_bad_in.M",
+		},
+		{
+			v:   nil,
+			msg: "ctypes: unsupported type [nil]",
+		},
+	} {
+		_, err := TypeOfErr(test.v)
+		if test.v != nil {
+			// once more, as the type may be left in the cache
+			_, err = TypeOfErr(test.v)
+		}
+		e, ok := err.(*UnsupportedTypeError)
+		if !ok {
+			t.Errorf("TypeOfErr(%T): got %v, want an *UnsupportedTypeError", test.v, err)
+			continue
+		}
+		if e.Type != test.typ || e.Path != test.path || e.Error() != test.msg {
+			t.Errorf("TypeOfErr(%T): got %#v (%q), want %v at %q (%q)",
+				test.v, e, e.Error(), test.typ, test.path, test.msg)
+		}
+		if _, err := ValueOfErr(test.v); err == nil || err.Error() != test.msg {
+			t.Errorf("ValueOfErr(%T): got %v, want %q", test.v, err, test.msg)
+		}
+		func() {
+			defer func() {
+				if r, ok := recover().(error); !ok || r.Error() != test.msg {
+					t.Errorf("TypeOf(%T): panicked with %v, want %q", test.v, r, test.msg)
+				}
+			}()
+			TypeOf(test.v)
+		}()
+	}
+
+	// a Value only encodes and decodes values of its own type
+	v := ValueOf(&test_order{})
+	if _, err := NewEncoder(v).Encode(&test_bad_in{}); err == nil {
+		t.Errorf("Encode: no error for a value of another type")
+	}
+	if _, err := NewDecoder(v).Decode(&test_bad_in{}); err == nil {
+		t.Errorf("Decode: no error for a value of another type")
+	}
+}
+
+type test_strings struct {
+	A, B string
+}
+
+// C-strings are decoded from the char* of the buffer, wherever they come from
+func TestDecodeString(t *testing.T) {
+	in := test_strings{"hello", ""}
+	src := ValueOf(&in)
+	encode(t, src, &in)
+	v := ValueOf(&in)
+	copy(v.Buffer(), src.Buffer())
+
+	var out test_strings
+	decode(t, v, &out)
+	if out != in {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+	v.SetMaxStringLen(3)
+	decode(t, v, &out)
+	if want := (test_strings{"hel", ""}); out != want {
+		t.Errorf("decoded %+v with at most 3 bytes, want %+v", out, want)
+	}
+	runtime.KeepAlive(src)
+
+	// a NULL char* is an empty string
+	v = ValueOf(&in)
+	out = test_strings{"x", "y"}
+	decode(t, v, &out)
+	if out != (test_strings{}) {
+		t.Errorf("decoded %+v from NULL, want empty strings", out)
+	}
+}
+
+type test_slices struct {
+	Xs []float64
+	Ys []int16
+}
+
+// decoded slices are copies, not aliases of the encoded ones
+func TestDecodeSlice(t *testing.T) {
+	in := test_slices{Xs: []float64{1, 2, 3}}
+	v := ValueOf(&in)
+	encode(t, v, &in)
+	var out test_slices
+	decode(t, v, &out)
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("decoded %+v, want %+v", out, in)
+	}
+	if &out.Xs[0] == &in.Xs[0] {
+		t.Errorf("decoded slice aliases the encoded one")
+	}
+	in.Xs[0] = 42
+	if out.Xs[0] != 1 {
+		t.Errorf("decoded slice changed with the encoded one: %v", out.Xs)
+	}
+}
+
+type (
+	ref_vl_before struct {
+		Xs []float64
+	}
+	ref_vl_after struct {
+		Xs []float64 `ctypes:"lentype=uint16_t,lenpos=after"`
+	}
+	ref_vl_shared struct {
+		N  uint32
+		Xs []float64 `ctypes:"len=N"`
+		Ys []float32 `ctypes:"len=N"`
+	}
+)
+
+func TestVLArrayLength(t *testing.T) {
+	check_layout(t, Host, "vl_before", ref_vl_before{}, cref.VLBefore)
+	check_layout(t, Host, "vl_after", ref_vl_after{}, cref.VLAfter)
+	check_layout(t, Host, "vl_shared", ref_vl_shared{}, cref.VLShared)
+
+	xs := []float64{1, 2, 3}
+	for _, test := range []struct {
+		in, out interface{}
+		off     uintptr // the offset of the length
+		want    interface{}
+	}{
+		{&ref_vl_before{xs}, &ref_vl_before{}, cref.VLBefore.Offsets[0], &ref_vl_before{xs}},
+		{&ref_vl_after{xs}, &ref_vl_after{}, cref.VLAfter.Offsets[1], &ref_vl_after{xs}},
+		// the length field is set from the vl-arrays
+		{&ref_vl_shared{0, xs, []float32{4, 5, 6}}, &ref_vl_shared{},
+			cref.VLShared.Offsets[0], &ref_vl_shared{3, xs, []float32{4, 5, 6}}},
+	} {
+		v := ValueOf(test.in)
+		encode(t, v, test.in)
+		if n := v.Buffer()[test.off]; n != 3 {
+			t.Errorf("%T: length %d, want 3", test.in, n)
+		}
+		decode(t, v, test.out)
+		if !reflect.DeepEqual(test.out, test.want) {
+			t.Errorf("%T: decoded %+v, want %+v", test.in, test.out, test.want)
+		}
+	}
+
+	in := ref_vl_shared{Xs: xs, Ys: []float32{4}}
+	_, err := NewEncoder(ValueOf(&in)).Encode(&in)
+	if e, ok := err.(*LengthError); !ok || e.Path != "ref_vl_shared.N" || e.Len != 3 || e.Other != 1 {
+		t.Errorf("got %v, want a *LengthError for ref_vl_shared.N", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	in := test_strings{"hello", "world"}
+	ct := TypeOf(in)
+	mem := NewC(ct)
+	encode(t, mem, &in)
+	for _, v := range []*Value{ValueOf(&in), NewC(ct), ValueAt(ct, mem.UnsafeAddress())} {
+		encode(t, v, &in)
+		for i := 0; i < 2; i++ {
+			if err := v.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		}
+		if v.UnsafeAddress() != nil || v.Buffer() != nil {
+			t.Errorf("closed Value still has a buffer")
+		}
+		if _, err := NewEncoder(v).Encode(&in); err != ErrClosed {
+			t.Errorf("Encode: got %v, want ErrClosed", err)
+		}
+		var out test_strings
+		if _, err := NewDecoder(v).Decode(&out); err != ErrClosed {
+			t.Errorf("Decode: got %v, want ErrClosed", err)
+		}
+	}
+
+	// closing a Value viewing C memory leaves the memory untouched
+	var out test_strings
+	decode(t, mem, &out)
+	if out != in {
+		t.Errorf("decoded %+v once the view closed, want %+v", out, in)
+	}
+	mem.Close()
+}
+
+// EOF
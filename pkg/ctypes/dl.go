@@ -0,0 +1,156 @@
+package ctypes
+
+/*
+ #cgo linux LDFLAGS: -ldl
+ #include <dlfcn.h>
+ #include <stdlib.h>
+ #include <string.h>
+
+ // dlerror is per-thread: it has to be read within the same C call
+ // as the failing dl function. *err is malloc'ed.
+ static char* ctypes_dlerror(void) {
+	 const char* msg = dlerror();
+	 return strdup(msg != NULL ? msg : "unknown error");
+ }
+
+ static void* ctypes_dlopen(const char* name, int flags, char** err) {
+	 void* h;
+	 dlerror();
+	 h = dlopen(name, flags);
+	 if (h == NULL) {
+		 *err = ctypes_dlerror();
+	 }
+	 return h;
+ }
+
+ static void* ctypes_dlsym(void* h, const char* name, char** err) {
+	 void* sym;
+	 const char* msg;
+	 dlerror();
+	 sym = dlsym(h, name);
+	 // a symbol may legitimately be NULL: only dlerror tells
+	 msg = dlerror();
+	 if (msg != NULL) {
+		 *err = strdup(msg);
+	 }
+	 return sym;
+ }
+
+ static int ctypes_dlclose(void* h, char** err) {
+	 int rc;
+	 dlerror();
+	 rc = dlclose(h);
+	 if (rc != 0) {
+		 *err = ctypes_dlerror();
+	 }
+	 return rc;
+ }
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// Flags of LoadLibraryFlags, as for dlopen(3)
+const (
+	RTLD_LAZY   = int(C.RTLD_LAZY)   // resolve symbols when first used
+	RTLD_NOW    = int(C.RTLD_NOW)    // resolve all symbols when loading
+	RTLD_GLOBAL = int(C.RTLD_GLOBAL) // make symbols available to libraries loaded later
+	RTLD_LOCAL  = int(C.RTLD_LOCAL)  // the opposite of RTLD_GLOBAL, the default
+)
+
+// ErrLibraryClosed is returned when looking up a symbol in a closed Library
+var ErrLibraryClosed = errors.New("ctypes: use of closed Library")
+
+// A LibraryError is returned when a shared library can not be loaded,
+// closed, or a symbol can not be found in it.
+type LibraryError struct {
+	Op   string // the failing operation: "load", "lookup" or "close"
+	Name string // the name of the library, or of the symbol
+	Msg  string // the message of dlerror(3)
+}
+
+func (e *LibraryError) Error() string {
+	return "ctypes: " + e.Op + " " + e.Name + ": " + e.Msg
+}
+
+// A Library is a shared library loaded at runtime.
+// It is safe for concurrent use.
+type Library struct {
+	name string
+	mu   sync.RWMutex   // protects h
+	h    unsafe.Pointer // the dlopen handle, nil once closed
+}
+
+// LoadLibrary loads the shared library name, e.g. "libm.so.6", resolving
+// all its symbols (RTLD_NOW.) An empty name gives the main program.
+func LoadLibrary(name string) (*Library, error) {
+	return LoadLibraryFlags(name, RTLD_NOW)
+}
+
+// LoadLibraryFlags loads the shared library name with the given RTLD_xxx
+// flags. An empty name gives the main program.
+func LoadLibraryFlags(name string, flags int) (*Library, error) {
+	var cname *C.char
+	if name != "" {
+		cname = C.CString(name)
+		defer C.free(unsafe.Pointer(cname))
+	}
+	var cerr *C.char
+	h := C.ctypes_dlopen(cname, C.int(flags), &cerr)
+	if h == nil {
+		return nil, &LibraryError{"load", name, dl_error(cerr)}
+	}
+	return &Library{name: name, h: h}, nil
+}
+
+// Name returns the name the library was loaded with
+func (l *Library) Name() string {
+	return l.name
+}
+
+// Lookup returns the address of the symbol name of the library
+func (l *Library) Lookup(name string) (unsafe.Pointer, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.h == nil {
+		return nil, ErrLibraryClosed
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var cerr *C.char
+	sym := C.ctypes_dlsym(l.h, cname, &cerr)
+	if cerr != nil {
+		return nil, &LibraryError{"lookup", name, dl_error(cerr)}
+	}
+	return sym, nil
+}
+
+// Close unloads the library, once all the references to it are closed
+// (see dlclose(3).) The addresses looked up in it must not be used anymore.
+// Closing a Library more than once is a no-op.
+func (l *Library) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.h == nil {
+		return nil
+	}
+	var cerr *C.char
+	rc := C.ctypes_dlclose(l.h, &cerr)
+	l.h = nil
+	if rc != 0 {
+		return &LibraryError{"close", l.name, dl_error(cerr)}
+	}
+	return nil
+}
+
+// dl_error returns the Go copy of the malloc'ed error message cerr
+func dl_error(cerr *C.char) string {
+	defer C.free(unsafe.Pointer(cerr))
+	return C.GoString(cerr)
+}
+
+// EOF
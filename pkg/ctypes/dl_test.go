@@ -0,0 +1,55 @@
+package ctypes
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLoadLibrary(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("no libc.so.6 on %s", runtime.GOOS)
+	}
+	for _, name := range []string{"libc.so.6", ""} {
+		lib, err := LoadLibrary(name)
+		if err != nil {
+			t.Fatalf("LoadLibrary(%q): %v", name, err)
+		}
+		if lib.Name() != name {
+			t.Errorf("LoadLibrary(%q): named %q", name, lib.Name())
+		}
+		if sym, err := lib.Lookup("strlen"); sym == nil || err != nil {
+			t.Errorf("%q: strlen at %v (%v)", name, sym, err)
+		}
+		_, err = lib.Lookup("ctypes_no_such_symbol")
+		if e, ok := err.(*LibraryError); !ok || e.Op != "lookup" || e.Name != "ctypes_no_such_symbol" || e.Msg == "" {
+			t.Errorf("%q: got %v, want a lookup *LibraryError", name, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := lib.Close(); err != nil {
+				t.Errorf("%q: Close: %v", name, err)
+			}
+		}
+		if _, err := lib.Lookup("strlen"); err != ErrLibraryClosed {
+			t.Errorf("%q: Lookup once closed: got %v, want ErrLibraryClosed", name, err)
+		}
+	}
+}
+
+func TestLoadLibraryError(t *testing.T) {
+	const name = "libctypes-no-such-library.so"
+	for _, flags := range []int{RTLD_NOW, RTLD_LAZY | RTLD_GLOBAL} {
+		lib, err := LoadLibraryFlags(name, flags)
+		e, ok := err.(*LibraryError)
+		if lib != nil || !ok || e.Op != "load" || e.Name != name || e.Msg == "" {
+			t.Errorf("got %v, %v, want a load *LibraryError", lib, err)
+			continue
+		}
+		if !strings.HasPrefix(e.Error(), "ctypes: load "+name+": ") {
+			t.Errorf("error message %q", e.Error())
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,303 @@
+// Package cref holds the layouts the C compiler gives to the reference
+// structs the tests of ctypes compare their own layouts against.
+// Test files can not use cgo: they import this package instead.
+package cref
+
+/*
+ #include <stddef.h>
+ #include <stdint.h>
+ #include <string.h>
+
+ struct natural { char c; double d; short s; int i; char c2; };
+ struct nested  { char c; struct natural n; short s; };
+ struct arrays  { char c; int32_t a[3]; char c2; long l; };
+ struct mixed   { unsigned char u; char *s; float f; uint16_t h; void *p; double d; };
+ struct tail    { double d; char c; };
+
+ union  variant { char c; double d; int32_t i[3]; };
+ struct tagged  { int32_t kind; union variant u; char c; };
+
+ struct mapped {
+	 unsigned char flags;
+	 long count;
+	 short level;
+	 float ratio;
+	 int64_t big __attribute__((aligned(16)));
+	 uint32_t port;
+ };
+
+ struct vl_before { long n; double *xs; };
+ struct vl_after  { double *xs; uint16_t n; };
+ struct vl_shared { uint32_t n; double *xs; float *ys; };
+
+ struct named { char name[8]; int32_t id; char tag[3]; double x; };
+
+ struct __attribute__((packed)) packed1 { char c; double d; short s; int i; };
+ struct outer1 { char c; struct packed1 p; int32_t x; };
+ #pragma pack(push, 2)
+ struct packed2 { char c; double d; short s; int i; char c2; };
+ #pragma pack(pop)
+
+ struct bits {
+	 uint32_t a:3, b:7;
+	 int32_t c:5;
+	 uint32_t :0;
+	 uint8_t d;
+	 uint16_t e:9, f:9;
+	 uint64_t g:40;
+ };
+
+ static void bits_image(void *p, uint32_t a, uint32_t b, int32_t c, uint8_t d,
+			uint16_t e, uint16_t f, uint64_t g) {
+	 struct bits x;
+	 memset(&x, 0, sizeof x);
+	 x.a = a; x.b = b; x.c = c; x.d = d; x.e = e; x.f = f; x.g = g;
+	 memcpy(p, &x, sizeof x);
+ }
+
+ #define CREF_FALIGN(T) offsetof(struct { char c; T x; }, x)
+
+ enum {
+	 natural_size  = sizeof(struct natural),
+	 natural_align = __alignof__(struct natural),
+	 natural_c     = offsetof(struct natural, c),
+	 natural_d     = offsetof(struct natural, d),
+	 natural_s     = offsetof(struct natural, s),
+	 natural_i     = offsetof(struct natural, i),
+	 natural_c2    = offsetof(struct natural, c2),
+
+	 nested_size  = sizeof(struct nested),
+	 nested_align = __alignof__(struct nested),
+	 nested_c     = offsetof(struct nested, c),
+	 nested_n     = offsetof(struct nested, n),
+	 nested_s     = offsetof(struct nested, s),
+
+	 arrays_size  = sizeof(struct arrays),
+	 arrays_align = __alignof__(struct arrays),
+	 arrays_c     = offsetof(struct arrays, c),
+	 arrays_a     = offsetof(struct arrays, a),
+	 arrays_c2    = offsetof(struct arrays, c2),
+	 arrays_l     = offsetof(struct arrays, l),
+
+	 mixed_size  = sizeof(struct mixed),
+	 mixed_align = __alignof__(struct mixed),
+	 mixed_u     = offsetof(struct mixed, u),
+	 mixed_s     = offsetof(struct mixed, s),
+	 mixed_f     = offsetof(struct mixed, f),
+	 mixed_h     = offsetof(struct mixed, h),
+	 mixed_p     = offsetof(struct mixed, p),
+	 mixed_d     = offsetof(struct mixed, d),
+
+	 tail_size  = sizeof(struct tail),
+	 tail_align = __alignof__(struct tail),
+	 tail_d     = offsetof(struct tail, d),
+	 tail_c     = offsetof(struct tail, c),
+
+	 variant_size  = sizeof(union variant),
+	 variant_align = __alignof__(union variant),
+	 variant_c     = offsetof(union variant, c),
+	 variant_d     = offsetof(union variant, d),
+	 variant_i     = offsetof(union variant, i),
+
+	 tagged_size  = sizeof(struct tagged),
+	 tagged_align = __alignof__(struct tagged),
+	 tagged_kind  = offsetof(struct tagged, kind),
+	 tagged_u     = offsetof(struct tagged, u),
+	 tagged_c     = offsetof(struct tagged, c),
+
+	 mapped_size  = sizeof(struct mapped),
+	 mapped_align = __alignof__(struct mapped),
+	 mapped_flags = offsetof(struct mapped, flags),
+	 mapped_count = offsetof(struct mapped, count),
+	 mapped_level = offsetof(struct mapped, level),
+	 mapped_ratio = offsetof(struct mapped, ratio),
+	 mapped_big   = offsetof(struct mapped, big),
+	 mapped_port  = offsetof(struct mapped, port),
+
+	 vl_before_size  = sizeof(struct vl_before),
+	 vl_before_align = __alignof__(struct vl_before),
+	 vl_before_n     = offsetof(struct vl_before, n),
+	 vl_before_xs    = offsetof(struct vl_before, xs),
+
+	 vl_after_size  = sizeof(struct vl_after),
+	 vl_after_align = __alignof__(struct vl_after),
+	 vl_after_xs    = offsetof(struct vl_after, xs),
+	 vl_after_n     = offsetof(struct vl_after, n),
+
+	 vl_shared_size  = sizeof(struct vl_shared),
+	 vl_shared_align = __alignof__(struct vl_shared),
+	 vl_shared_n     = offsetof(struct vl_shared, n),
+	 vl_shared_xs    = offsetof(struct vl_shared, xs),
+	 vl_shared_ys    = offsetof(struct vl_shared, ys),
+
+	 named_size  = sizeof(struct named),
+	 named_align = __alignof__(struct named),
+	 named_name  = offsetof(struct named, name),
+	 named_id    = offsetof(struct named, id),
+	 named_tag   = offsetof(struct named, tag),
+	 named_x     = offsetof(struct named, x),
+
+	 packed1_size  = sizeof(struct packed1),
+	 packed1_align = __alignof__(struct packed1),
+	 packed1_c     = offsetof(struct packed1, c),
+	 packed1_d     = offsetof(struct packed1, d),
+	 packed1_s     = offsetof(struct packed1, s),
+	 packed1_i     = offsetof(struct packed1, i),
+
+	 outer1_size  = sizeof(struct outer1),
+	 outer1_align = __alignof__(struct outer1),
+	 outer1_c     = offsetof(struct outer1, c),
+	 outer1_p     = offsetof(struct outer1, p),
+	 outer1_x     = offsetof(struct outer1, x),
+
+	 packed2_size  = sizeof(struct packed2),
+	 packed2_align = __alignof__(struct packed2),
+	 packed2_c     = offsetof(struct packed2, c),
+	 packed2_d     = offsetof(struct packed2, d),
+	 packed2_s     = offsetof(struct packed2, s),
+	 packed2_i     = offsetof(struct packed2, i),
+	 packed2_c2    = offsetof(struct packed2, c2),
+
+	 bits_size  = sizeof(struct bits),
+	 bits_align = __alignof__(struct bits),
+
+	 char_align      = __alignof__(char),
+	 char_falign     = CREF_FALIGN(char),
+	 short_align     = __alignof__(short),
+	 short_falign    = CREF_FALIGN(short),
+	 int_align       = __alignof__(int),
+	 int_falign      = CREF_FALIGN(int),
+	 long_align      = __alignof__(long),
+	 long_falign     = CREF_FALIGN(long),
+	 longlong_align  = __alignof__(long long),
+	 longlong_falign = CREF_FALIGN(long long),
+	 float_align     = __alignof__(float),
+	 float_falign    = CREF_FALIGN(float),
+	 double_align    = __alignof__(double),
+	 double_falign   = CREF_FALIGN(double),
+	 ptr_align       = __alignof__(void*),
+	 ptr_falign      = CREF_FALIGN(void*),
+ };
+*/
+import "C"
+
+import "unsafe"
+
+// A Layout is the layout of a C struct or union
+type Layout struct {
+	Size    uintptr
+	Align   uintptr
+	Offsets []uintptr // the offsets of its fields, in order
+}
+
+// An Alignment is the alignment of a C scalar, standalone and as the
+// field of a struct
+type Alignment struct {
+	Align, FieldAlign uintptr
+}
+
+// the alignments of the C scalars, by name
+var Scalars = map[string]Alignment{
+	"char":      {C.char_align, C.char_falign},
+	"short":     {C.short_align, C.short_falign},
+	"int":       {C.int_align, C.int_falign},
+	"long":      {C.long_align, C.long_falign},
+	"long long": {C.longlong_align, C.longlong_falign},
+	"float":     {C.float_align, C.float_falign},
+	"double":    {C.double_align, C.double_falign},
+	"void*":     {C.ptr_align, C.ptr_falign},
+}
+
+var (
+	// struct natural { char c; double d; short s; int i; char c2; }
+	Natural = Layout{C.natural_size, C.natural_align, []uintptr{
+		C.natural_c, C.natural_d, C.natural_s, C.natural_i, C.natural_c2}}
+
+	// struct nested { char c; struct natural n; short s; }
+	Nested = Layout{C.nested_size, C.nested_align, []uintptr{C.nested_c, C.nested_n, C.nested_s}}
+
+	// struct arrays { char c; int32_t a[3]; char c2; long l; }
+	Arrays = Layout{C.arrays_size, C.arrays_align, []uintptr{
+		C.arrays_c, C.arrays_a, C.arrays_c2, C.arrays_l}}
+
+	// struct mixed { unsigned char u; char *s; float f; uint16_t h; void *p; double d; }
+	Mixed = Layout{C.mixed_size, C.mixed_align, []uintptr{
+		C.mixed_u, C.mixed_s, C.mixed_f, C.mixed_h, C.mixed_p, C.mixed_d}}
+
+	// struct tail { double d; char c; }
+	Tail = Layout{C.tail_size, C.tail_align, []uintptr{C.tail_d, C.tail_c}}
+
+	// union variant { char c; double d; int32_t i[3]; }
+	Variant = Layout{C.variant_size, C.variant_align, []uintptr{
+		C.variant_c, C.variant_d, C.variant_i}}
+
+	// struct tagged { int32_t kind; union variant u; char c; }
+	Tagged = Layout{C.tagged_size, C.tagged_align, []uintptr{
+		C.tagged_kind, C.tagged_u, C.tagged_c}}
+
+	// struct mapped { unsigned char flags; long count; short level; float ratio;
+	//	int64_t big __attribute__((aligned(16))); uint32_t port; }
+	Mapped = Layout{C.mapped_size, C.mapped_align, []uintptr{
+		C.mapped_flags, C.mapped_count, C.mapped_level,
+		C.mapped_ratio, C.mapped_big, C.mapped_port}}
+
+	// struct vl_before { long n; double *xs; }
+	VLBefore = Layout{C.vl_before_size, C.vl_before_align, []uintptr{
+		C.vl_before_n, C.vl_before_xs}}
+
+	// struct vl_after { double *xs; uint16_t n; }
+	VLAfter = Layout{C.vl_after_size, C.vl_after_align, []uintptr{
+		C.vl_after_xs, C.vl_after_n}}
+
+	// struct vl_shared { uint32_t n; double *xs; float *ys; }
+	VLShared = Layout{C.vl_shared_size, C.vl_shared_align, []uintptr{
+		C.vl_shared_n, C.vl_shared_xs, C.vl_shared_ys}}
+
+	// struct named { char name[8]; int32_t id; char tag[3]; double x; }
+	Named = Layout{C.named_size, C.named_align, []uintptr{
+		C.named_name, C.named_id, C.named_tag, C.named_x}}
+
+	// struct __attribute__((packed)) packed1 { char c; double d; short s; int i; }
+	Packed1 = Layout{C.packed1_size, C.packed1_align, []uintptr{
+		C.packed1_c, C.packed1_d, C.packed1_s, C.packed1_i}}
+
+	// struct outer1 { char c; struct packed1 p; int32_t x; }
+	Outer1 = Layout{C.outer1_size, C.outer1_align, []uintptr{
+		C.outer1_c, C.outer1_p, C.outer1_x}}
+
+	// #pragma pack(2)
+	// struct packed2 { char c; double d; short s; int i; char c2; }
+	Packed2 = Layout{C.packed2_size, C.packed2_align, []uintptr{
+		C.packed2_c, C.packed2_d, C.packed2_s, C.packed2_i, C.packed2_c2}}
+)
+
+// Bits holds the values of the fields of the C struct
+//
+//	struct bits {
+//		uint32_t a:3, b:7;
+//		int32_t c:5;
+//		uint32_t :0;
+//		uint8_t d;
+//		uint16_t e:9, f:9;
+//		uint64_t g:40;
+//	};
+type Bits struct {
+	A, B uint32
+	C    int32
+	D    uint8
+	E, F uint16
+	G    uint64
+}
+
+// BitsAlign is the alignment of struct bits
+const BitsAlign = C.bits_align
+
+// Image returns the bytes of the struct bits holding the values of b
+func (b Bits) Image() []byte {
+	img := make([]byte, C.bits_size)
+	C.bits_image(unsafe.Pointer(&img[0]), C.uint32_t(b.A), C.uint32_t(b.B), C.int32_t(b.C),
+		C.uint8_t(b.D), C.uint16_t(b.E), C.uint16_t(b.F), C.uint64_t(b.G))
+	return img
+}
+
+// EOF
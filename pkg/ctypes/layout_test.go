@@ -0,0 +1,157 @@
+package ctypes
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+// the Go twins of the reference structs of cref
+type (
+	ref_natural struct {
+		C  int8
+		D  float64
+		S  int16
+		I  int32
+		C2 int8
+	}
+	ref_nested struct {
+		C int8
+		N ref_natural
+		S int16
+	}
+	ref_arrays struct {
+		C  int8
+		A  [3]int32
+		C2 int8
+		L  int
+	}
+	ref_mixed struct {
+		U uint8
+		S string
+		F float32
+		H uint16
+		P unsafe.Pointer
+		D float64
+	}
+	ref_tail struct {
+		D float64
+		C int8
+	}
+)
+
+// check_layout checks the size, alignment and field offsets of the C type
+// of v against the ones of the C compiler
+func check_layout(t *testing.T, abi *ABI, name string, v interface{}, ref cref.Layout) Type {
+	ct, err := abi.TypeOfErr(v)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return nil
+	}
+	if ct.Size() != ref.Size {
+		t.Errorf("%s: size %d, want %d", name, ct.Size(), ref.Size)
+	}
+	if uintptr(ct.Align()) != ref.Align {
+		t.Errorf("%s: align %d, want %d", name, ct.Align(), ref.Align)
+	}
+	if ct.NumField() != len(ref.Offsets) {
+		t.Errorf("%s: %d fields, want %d", name, ct.NumField(), len(ref.Offsets))
+		return ct
+	}
+	for i, off := range ref.Offsets {
+		if f := ct.Field(i); f.Offset != off {
+			t.Errorf("%s.%s: offset %d, want %d", name, f.Name, f.Offset, off)
+		}
+	}
+	return ct
+}
+
+func TestLayoutHost(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		v    interface{}
+		ref  cref.Layout
+	}{
+		{"natural", ref_natural{}, cref.Natural},
+		{"nested", ref_nested{}, cref.Nested},
+		{"arrays", ref_arrays{}, cref.Arrays},
+		{"mixed", ref_mixed{}, cref.Mixed},
+		{"tail", ref_tail{}, cref.Tail},
+	} {
+		check_layout(t, Host, test.name, test.v, test.ref)
+	}
+}
+
+func TestAlignScalars(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"char", int8(0)},
+		{"short", int16(0)},
+		{"int", int32(0)},
+		{"long", int(0)},
+		{"long long", int64(0)},
+		{"float", float32(0)},
+		{"double", float64(0)},
+		{"void*", unsafe.Pointer(nil)},
+	} {
+		ct := TypeOf(test.v)
+		ref := cref.Scalars[test.name]
+		if uintptr(ct.Align()) != ref.Align {
+			t.Errorf("%s: align %d, want %d", test.name, ct.Align(), ref.Align)
+		}
+		if uintptr(ct.FieldAlign()) != ref.FieldAlign {
+			t.Errorf("%s: field align %d, want %d", test.name, ct.FieldAlign(), ref.FieldAlign)
+		}
+	}
+
+	// arrays are aligned as their elements
+	ct := TypeOf([3]float64{})
+	if ct.Align() != TypeOf(float64(0)).Align() || ct.FieldAlign() != TypeOf(float64(0)).FieldAlign() {
+		t.Errorf("[3]float64: align %d/%d", ct.Align(), ct.FieldAlign())
+	}
+}
+
+type (
+	ref_packed1 struct {
+		C int8
+		D float64
+		S int16
+		I int32
+	}
+	ref_outer1 struct {
+		C int8
+		P ref_packed1 `ctypes:"packed"`
+		X int32
+	}
+)
+
+func TestLayoutPacked(t *testing.T) {
+	check_layout(t, Host.WithPack(1), "packed1", ref_packed1{}, cref.Packed1)
+	check_layout(t, Host, "outer1", ref_outer1{}, cref.Outer1)
+	check_layout(t, Host.WithPack(2), "packed2", ref_natural{}, cref.Packed2)
+
+	// the packed variants share the types cache, not the layouts
+	check_layout(t, Host, "natural", ref_natural{}, cref.Natural)
+	if Host.WithPack(2) != Host.WithPack(2) || Host.WithPack(0) != Host {
+		t.Errorf("packed variants are not created once")
+	}
+
+	// packed values are encoded unaligned
+	in := ref_outer1{C: 1, P: ref_packed1{2, 3.5, 4, 5}, X: 6}
+	v := ValueOf(&in)
+	encode(t, v, &in)
+	var out ref_outer1
+	decode(t, v, &out)
+	if out != in {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+
+	if _, err := Host.WithPack(1).TypeOfErr(ref_bits{}); err == nil {
+		t.Errorf("no error for bit-fields in a packed struct")
+	}
+}
+
+// EOF
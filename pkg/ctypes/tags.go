@@ -0,0 +1,250 @@
+package ctypes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// The C mapping of a struct field can be adjusted with a `ctypes:"..."` tag,
+// a comma-separated list of options among:
+//
+//	name=n      the C name of the field
+//	skip or -   the field has no C counterpart: it is neither laid out,
+//	            encoded nor decoded
+//	type=t      the C scalar type of a numeric field, whose value is
+//	            converted: char, uchar, short, ushort, int, uint, long,
+//	            ulong, longlong, ulonglong, int8_t ... uint64_t, size_t,
+//	            ssize_t, ptrdiff_t, intptr_t, uintptr_t, float, double;
+//	            or char[n] for a string field (see CharArray)
+//	overflow=p  the policy for strings too long for their char[n]:
+//	            truncate (the default) or reject
+//	string=p    the policy of a string field: ptr (the default) for a
+//	            char* to a copy of the string, nullable to also encode an
+//	            empty string as NULL
+//	order=o     the byte order of the field: little (le) or big (be, network)
+//	align=n     the alignment of the field, instead of its natural one
+//	pack=n      the type of the field is laid out with the fields of its
+//	            structs aligned on at most n bytes (see ABI.WithPack)
+//	packed      the same as pack=1
+//	len=f       the length of a vl-array is the integer field f, which can
+//	            be shared by several vl-arrays, instead of a hidden field
+//	lentype=t   the C type of the hidden length of a vl-array (int by default)
+//	lenpos=p    the position of the hidden length of a vl-array: before
+//	            (the default) or after its pointer
+//	bits=n      see StructField.BitOffset
+//	union=d     see CUnion
+//
+// e.g. `ctypes:"name=ev_count,type=uint32_t,order=be"`
+type tag_opts map[string]string
+
+// has returns whether the option key is set
+func (opts tag_opts) has(key string) bool {
+	_, ok := opts[key]
+	return ok
+}
+
+func parse_tag(tag reflect.StructTag) tag_opts {
+	opts := make(tag_opts)
+	for _, opt := range strings.Split(tag.Get("ctypes"), ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		key, val := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+		opts[key] = val
+	}
+	return opts
+}
+
+// tag_error raises a StructTagError for the ctypes tag of the field
+// being walked
+func tag_error(tag reflect.StructTag, format string, args ...interface{}) {
+	panic(&StructTagError{
+		Tag: `ctypes:"` + tag.Get("ctypes") + `"`,
+		Msg: fmt.Sprintf(format, args...),
+	})
+}
+
+// field_mapping is the C mapping of a struct field, from its ctypes tag
+type field_mapping struct {
+	ctype    reflect.Type     // the Go type standing for the C type of the field, nil for its own
+	chars    *cchars_type     // the char array of a string field, nil for a char*
+	order    binary.ByteOrder // the byte order of the field, nil for the one of the ABI
+	nullable bool             // whether an empty string is encoded as NULL
+}
+
+// new_mapping returns the mapping of the struct field f from the options
+// of its tag, nil if it is mapped as usual
+func (abi *ABI) new_mapping(f reflect.StructField, opts tag_opts) *field_mapping {
+	m := &field_mapping{}
+	m.chars = abi.new_chars(f, opts)
+	if name, ok := opts["type"]; ok && m.chars == nil {
+		ct, ok := abi.c_scalar(name)
+		if !ok {
+			tag_error(f.Tag, "unknown C type [%s]", name)
+		}
+		if !is_number(f.Type) {
+			tag_error(f.Tag, "C type [%s] for non-numeric type [%v]", name, f.Type)
+		}
+		m.ctype = ct
+	}
+	if p, ok := opts["string"]; ok {
+		if f.Type.Kind() != reflect.String {
+			tag_error(f.Tag, "string policy for non-string type [%v]", f.Type)
+		}
+		switch p {
+		case "ptr":
+		case "nullable":
+			if m.chars != nil {
+				tag_error(f.Tag, "nullable char array")
+			}
+			m.nullable = true
+		default:
+			tag_error(f.Tag, "unknown string policy [%s]", p)
+		}
+	}
+	if o, ok := opts["order"]; ok {
+		switch o {
+		case "little", "le":
+			m.order = binary.LittleEndian
+		case "big", "be", "network":
+			m.order = binary.BigEndian
+		default:
+			tag_error(f.Tag, "unknown byte order [%s]", o)
+		}
+	}
+	if *m == (field_mapping{}) {
+		return nil
+	}
+	return m
+}
+
+// field_align returns the alignment of the struct field f set by
+// the options of its tag, 0 if none
+func field_align(f reflect.StructField, opts tag_opts) uintptr {
+	s, ok := opts["align"]
+	if !ok {
+		return 0
+	}
+	a, err := strconv.ParseUint(s, 0, 16)
+	if err != nil || a == 0 || a&(a-1) != 0 {
+		tag_error(f.Tag, "invalid alignment [%s]", s)
+	}
+	return uintptr(a)
+}
+
+// field_abi returns the ABI the type of the struct field f is laid out
+// for, given the options of its tag: a packed variant of abi, or abi.
+// the lock of abi.types_root() must be held.
+func (abi *ABI) field_abi(f reflect.StructField, opts tag_opts) *ABI {
+	if opts.has("packed") {
+		return abi.packed(1)
+	}
+	s, ok := opts["pack"]
+	if !ok {
+		return abi
+	}
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || n&(n-1) != 0 {
+		tag_error(f.Tag, "invalid pack [%s]", s)
+	}
+	return abi.packed(uintptr(n))
+}
+
+// is_number returns whether the Go type t is an integer or a float
+func is_number(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Bool:
+		return false
+	}
+	return is_integer(t)
+}
+
+// c_scalar returns the Go type laid out as the C scalar type name on this ABI
+func (abi *ABI) c_scalar(name string) (reflect.Type, bool) {
+	var x interface{}
+	switch strings.TrimSuffix(name, "_t") {
+	case "char", "schar", "int8":
+		x = int8(0)
+	case "uchar", "uint8":
+		x = uint8(0)
+	case "short", "int16":
+		x = int16(0)
+	case "ushort", "uint16":
+		x = uint16(0)
+	case "int", "int32":
+		x = int32(0)
+	case "uint", "uint32":
+		x = uint32(0)
+	case "longlong", "int64":
+		x = int64(0)
+	case "ulonglong", "uint64":
+		x = uint64(0)
+	case "long":
+		x = int32(0)
+		if abi.LongSize == 8 {
+			x = int64(0)
+		}
+	case "ulong":
+		x = uint32(0)
+		if abi.LongSize == 8 {
+			x = uint64(0)
+		}
+	case "ssize", "ptrdiff", "intptr":
+		// Go int and uintptr are PtrSize-bytes wide, see ABI
+		x = int(0)
+	case "size", "uintptr":
+		x = uintptr(0)
+	case "float":
+		x = float32(0)
+	case "double":
+		x = float64(0)
+	default:
+		return nil, false
+	}
+	return reflect.TypeOf(x), true
+}
+
+// encode_mapped encodes the struct field rv following its mapping m
+func encode_mapped(v *Value, rv reflect.Value, m *field_mapping) {
+	switch {
+	case m.ctype != nil:
+		x := reflect.New(m.ctype).Elem()
+		x.Set(writable(rv).Convert(m.ctype))
+		encode_value(v, x)
+	case m.chars != nil:
+		encode_chars(v, rv, m.chars)
+	case m.nullable && rv.Len() == 0:
+		null := uintptr(0)
+		encode_ptr(v, unsafe.Pointer(&null))
+	default:
+		encode_value(v, rv)
+	}
+}
+
+// decode_mapped decodes the struct field rv following its mapping m
+func decode_mapped(v *Value, rv reflect.Value, m *field_mapping) {
+	if m.ctype != nil {
+		x := reflect.New(m.ctype).Elem()
+		decode_value(v, x)
+		writable(rv).Set(x.Convert(rv.Type()))
+		return
+	}
+	if m.chars != nil {
+		decode_chars(v, rv, m.chars)
+		return
+	}
+	// a NULL C-string is decoded as an empty string anyway
+	decode_value(v, rv)
+}
+
+// EOF
@@ -0,0 +1,106 @@
+package ctypes
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+type ref_mapped struct {
+	Flags int      `ctypes:"name=flags,type=uchar"`
+	Skip  chan int `ctypes:"-"`
+	Count int64    `ctypes:"type=long"`
+	Level int      `ctypes:"type=short"`
+	Ratio float64  `ctypes:"type=float"`
+	Big   int64    `ctypes:"align=16"`
+	Port  uint16   `ctypes:"type=uint32_t,order=be"`
+}
+
+func TestTags(t *testing.T) {
+	ct := check_layout(t, Host, "mapped", ref_mapped{}, cref.Mapped)
+	if ct == nil {
+		return
+	}
+	if name := ct.Field(0).Name; name != "flags" {
+		t.Errorf("field 0 named %q, want %q", name, "flags")
+	}
+
+	in := ref_mapped{Flags: 0x81, Count: -5, Level: -2, Ratio: 0.25, Big: 1 << 40, Port: 8080}
+	v := ValueOf(&in)
+	encode(t, v, &in)
+	if port := binary.BigEndian.Uint32(v.Buffer()[cref.Mapped.Offsets[5]:]); port != 8080 {
+		t.Errorf("port encoded as %d", port)
+	}
+	var out ref_mapped
+	decode(t, v, &out)
+	if out != in {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+}
+
+type test_nullable struct {
+	S string `ctypes:"string=nullable"`
+	T string
+}
+
+func TestTagNullable(t *testing.T) {
+	in := test_nullable{}
+	v := ValueOf(&in)
+	encode(t, v, &in)
+	ptrs := (*[2]unsafe.Pointer)(unsafe.Pointer(&v.Buffer()[0]))
+	if ptrs[0] != nil || ptrs[1] == nil {
+		t.Errorf("empty strings encoded as %v, %v, want NULL and a char*", ptrs[0], ptrs[1])
+	}
+	in.S = "x"
+	encode(t, v, &in)
+	var out test_nullable
+	decode(t, v, &out)
+	if out != in {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+}
+
+func TestTagErrors(t *testing.T) {
+	for _, test := range []struct {
+		tag string
+		v   interface{} // the value of the field
+	}{
+		{"type=quad", 0},
+		{"type=int", ""},
+		{"order=middle", 0},
+		{"align=3", 0},
+		{"string=nullable", 0},
+		{"string=maybe", ""},
+		{"pack=3", struct{ B int }{}},
+		{"type=char[0]", ""},
+		{"type=char[4]", 0},
+		{"overflow=reject", ""},
+		{"type=char[4],overflow=maybe", ""},
+		{"lenpos=middle", []int{}},
+		{"lentype=float", []int{}},
+		{"len=X", []int{}},
+		{"len=A,lentype=int", []int{}},
+	} {
+		st := reflect.StructOf([]reflect.StructField{{
+			Name: "A",
+			Type: reflect.TypeOf(test.v),
+			Tag:  reflect.StructTag(`ctypes:"` + test.tag + `"`),
+		}})
+		_, err := TypeOfErr(reflect.Zero(st).Interface())
+		e, ok := err.(*StructTagError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *StructTagError", test.tag, err)
+			continue
+		}
+		// the path starts with the anonymous struct type
+		if !strings.HasSuffix(e.Path, "}.A") {
+			t.Errorf("%s: error at %q, want the field A", test.tag, e.Path)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,238 @@
+package ctypes
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// CUnion marks a Go struct as a C union when it is the type of one of its
+// fields: all the other fields are the members of the union, laid out at
+// offset 0. e.g.
+//
+//	type Variant struct {
+//		_ ctypes.CUnion
+//		I int64   `ctypes:"case=1"`
+//		F float64 `ctypes:"case=2"`
+//	}
+//
+// Only one member of a union is encoded or decoded: the one selected by the
+// discriminator field named by the `ctypes:"union=..."` tag of the union
+// field in its enclosing struct, matched against the `ctypes:"case=..."`
+// tags of the members (several cases are separated by '|'), or the first
+// member when the union is not driven by a discriminator.
+// The SetMember and Member methods of Value select a member by name.
+type CUnion struct{}
+
+var g_cunion = reflect.TypeOf(CUnion{})
+
+// is_union returns whether the Go struct t is marked as a C union
+func is_union(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type == g_cunion {
+			return true
+		}
+	}
+	return false
+}
+
+type cunion_type struct {
+	common_type
+	members     []StructField
+	members_map map[string]int
+	goidx       []int         // the index of each member in the Go struct
+	cases       map[int64]int // the member selected by each discriminator value
+	size        uintptr       // size of the largest member, including tail padding
+	align       uintptr       // alignment of the most aligned member
+}
+
+func new_cunion(abi *ABI, t reflect.Type) *cunion_type {
+	c := &cunion_type{
+		common_type: common_type{t, abi},
+		members_map: make(map[string]int),
+		cases:       make(map[int64]int),
+	}
+
+	// see new_cstruct
+	abi.register(t, c)
+	done := false
+	defer func() {
+		if !done {
+			abi.unregister(t)
+		}
+	}()
+
+	name := ""
+	defer field_error(&name)
+
+	size := uintptr(0)
+	align := uintptr(1)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type == g_cunion {
+			continue
+		}
+		name = f.Name
+		cf := abi.new_ctype(f.Type)
+		idx := len(c.members)
+		if cases, ok := parse_tag(f.Tag)["case"]; ok {
+			for _, s := range strings.Split(cases, "|") {
+				x, err := strconv.ParseInt(s, 0, 64)
+				if err != nil {
+					tag_error(f.Tag, "invalid case [%s]", s)
+				}
+				if _, dup := c.cases[x]; dup {
+					tag_error(f.Tag, "duplicate case [%d]", x)
+				}
+				c.cases[x] = idx
+			}
+		}
+		c.members = append(c.members, StructField{
+			PkgPath:   f.PkgPath,
+			Name:      f.Name,
+			Type:      cf,
+			Tag:       string(f.Tag),
+			Offset:    0,
+			Index:     []int{idx},
+			Anonymous: f.Anonymous,
+		})
+		c.members_map[f.Name] = idx
+		c.goidx = append(c.goidx, i)
+		if sz := cf.Size(); sz > size {
+			size = sz
+		}
+		if fa := abi.pack_align(uintptr(cf.FieldAlign())); fa > align {
+			align = fa
+		}
+	}
+	c.size = align_up(size, align)
+	c.align = align
+	done = true
+	return c
+}
+
+func (t *cunion_type) Kind() Kind {
+	return Union
+}
+
+func (t *cunion_type) Field(i int) StructField {
+	return t.members[i]
+}
+
+func (t *cunion_type) NumField() int {
+	return len(t.members)
+}
+
+func (t *cunion_type) Size() uintptr {
+	return t.size
+}
+
+func (t *cunion_type) Align() int {
+	return int(t.align)
+}
+
+func (t *cunion_type) FieldAlign() int {
+	return int(t.align)
+}
+
+// member returns the index of the member selected by the discriminator
+// value x, or -1 if there is none
+func (t *cunion_type) member(x int64) int {
+	if m, ok := t.cases[x]; ok {
+		return m
+	}
+	return -1
+}
+
+// default_member returns the index of the member encoded and decoded
+// when the union is not driven by a discriminator
+func (t *cunion_type) default_member() int {
+	if len(t.members) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// encode_union encodes the m-th member of the Go union rv, none if m < 0.
+// The bytes not covered by the member are left as is.
+func encode_union(v *Value, rv reflect.Value, ut *cunion_type, m int) {
+	base := v.idx
+	if m >= 0 {
+		encode_value(v, rv.Field(ut.goidx[m]))
+	}
+	v.idx = base + int(ut.Size())
+}
+
+// decode_union decodes the m-th member of the Go union rv, none if m < 0.
+// The other members are zeroed.
+func decode_union(v *Value, rv reflect.Value, ut *cunion_type, m int) {
+	base := v.idx
+	dst := writable(rv)
+	dst.Set(reflect.Zero(rv.Type()))
+	if m >= 0 {
+		decode_value(v, rv.Field(ut.goidx[m]))
+	}
+	v.idx = base + int(ut.Size())
+}
+
+// union_member returns the union type of v and the index of its member name
+func (v *Value) union_member(name string) (*cunion_type, int, error) {
+	ut, ok := v.t.(*cunion_type)
+	if !ok {
+		return nil, -1, fmt.Errorf("ctypes: value of type [%s] is not a union", v.t.String())
+	}
+	m, ok := ut.members_map[name]
+	if !ok {
+		return nil, -1, fmt.Errorf("ctypes: union [%s] has no member [%s]", v.t.String(), name)
+	}
+	return ut, m, nil
+}
+
+// SetMember encodes x, a pointer to a Go value of the type of the member
+// name, as that member of the union held by v.
+func (v *Value) SetMember(name string, x interface{}) (err error) {
+	if v.is_closed() {
+		return ErrClosed
+	}
+	ut, m, err := v.union_member(name)
+	if err != nil {
+		return err
+	}
+	rv := follow_ptr(reflect.ValueOf(x))
+	ft := ut.members[m].Type.GoType()
+	if !rv.IsValid() || rv.Type() != ft {
+		return fmt.Errorf("cannot encode this type [%v] as member [%s]", reflect.TypeOf(x), name)
+	}
+	defer catch_error(ft, &err)
+	v.Reset()
+	v.track_pointers(rv)
+	defer v.untrack_pointers()
+	encode_value(v, rv)
+	return nil
+}
+
+// Member decodes the member name of the union held by v into x,
+// a pointer to a Go value of the type of that member.
+func (v *Value) Member(name string, x interface{}) (err error) {
+	if v.is_closed() {
+		return ErrClosed
+	}
+	ut, m, err := v.union_member(name)
+	if err != nil {
+		return err
+	}
+	rv := follow_ptr(reflect.ValueOf(x))
+	ft := ut.members[m].Type.GoType()
+	if !rv.IsValid() || rv.Type() != ft {
+		return fmt.Errorf("cannot decode this type [%v] as member [%s]", reflect.TypeOf(x), name)
+	}
+	defer catch_error(ft, &err)
+	v.idx = 0
+	v.track_pointers(rv)
+	defer v.untrack_pointers()
+	decode_value(v, rv)
+	return nil
+}
+
+// EOF
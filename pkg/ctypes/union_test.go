@@ -0,0 +1,108 @@
+package ctypes
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/sbinet/go-ctypes/pkg/ctypes/internal/cref"
+)
+
+type (
+	ref_variant struct {
+		_ CUnion
+		C int8     `ctypes:"case=1"`
+		D float64  `ctypes:"case=2"`
+		I [3]int32 `ctypes:"case=3|4"`
+	}
+	ref_tagged struct {
+		Kind int32
+		U    ref_variant `ctypes:"union=Kind"`
+		C    int8
+	}
+)
+
+func TestUnionLayout(t *testing.T) {
+	check_layout(t, Host, "variant", ref_variant{}, cref.Variant)
+	check_layout(t, Host, "tagged", ref_tagged{}, cref.Tagged)
+}
+
+func TestUnion(t *testing.T) {
+	for _, test := range []struct {
+		in  ref_tagged
+		out ref_tagged // only the selected member is decoded
+	}{
+		{
+			ref_tagged{Kind: 1, U: ref_variant{C: 7, D: 1.5}, C: 9},
+			ref_tagged{Kind: 1, U: ref_variant{C: 7}, C: 9},
+		},
+		{
+			ref_tagged{Kind: 2, U: ref_variant{C: 7, D: 1.5}, C: 9},
+			ref_tagged{Kind: 2, U: ref_variant{D: 1.5}, C: 9},
+		},
+		{
+			ref_tagged{Kind: 4, U: ref_variant{D: 1.5, I: [3]int32{1, 2, 3}}},
+			ref_tagged{Kind: 4, U: ref_variant{I: [3]int32{1, 2, 3}}},
+		},
+		{
+			// no member for this discriminator
+			ref_tagged{Kind: 5, U: ref_variant{C: 7, D: 1.5}, C: 9},
+			ref_tagged{Kind: 5, C: 9},
+		},
+	} {
+		v := ValueOf(&test.in)
+		encode(t, v, &test.in)
+		var out ref_tagged
+		decode(t, v, &out)
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("kind %d: decoded %+v, want %+v", test.in.Kind, out, test.out)
+		}
+	}
+
+	// the members share the same bytes
+	in := ref_tagged{Kind: 2, U: ref_variant{D: 1.5}}
+	v := ValueOf(&in)
+	encode(t, v, &in)
+	b := v.Buffer()[cref.Tagged.Offsets[1]:]
+	if got := math.Float64frombits(binary.LittleEndian.Uint64(b)); got != 1.5 {
+		t.Errorf("double member encoded as %v", got)
+	}
+}
+
+func TestUnionMember(t *testing.T) {
+	v := ValueOf(&ref_variant{})
+
+	// without a discriminator, the first member is encoded
+	in := ref_variant{C: 7, D: 1.5}
+	encode(t, v, &in)
+	var out ref_variant
+	decode(t, v, &out)
+	if want := (ref_variant{C: 7}); out != want {
+		t.Errorf("decoded %+v, want %+v", out, want)
+	}
+
+	d := 2.5
+	if err := v.SetMember("D", &d); err != nil {
+		t.Fatal(err)
+	}
+	d = 0
+	if err := v.Member("D", &d); err != nil || d != 2.5 {
+		t.Errorf("member D: got %v (%v), want 2.5", d, err)
+	}
+	var i [3]int32
+	if err := v.Member("I", &i); err != nil || i[0] != int32(math.Float64bits(2.5)) {
+		t.Errorf("member I: got %v (%v), want the bytes of 2.5", i, err)
+	}
+	if err := v.Member("X", &d); err == nil {
+		t.Errorf("member X: no error for an unknown member")
+	}
+	if err := v.Member("D", &i); err == nil {
+		t.Errorf("member D: no error for a value of another type")
+	}
+	if err := ValueOf(&d).SetMember("D", &d); err == nil {
+		t.Errorf("SetMember: no error for a value which is not a union")
+	}
+}
+
+// EOF